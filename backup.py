@@ -3,11 +3,13 @@
 from pathlib import Path
 from argparse import ArgumentParser, ArgumentDefaultsHelpFormatter
 from configparser import ConfigParser
-from pprint import pprint
+from pprint import pformat
+import errno
 import os
 import re
 import sys
 from shutil import which
+from time import monotonic
 import subprocess
 
 config = ConfigParser()
@@ -24,16 +26,142 @@ parser = ArgumentParser(
 )
 
 parser.add_argument('-c', '--config', type=Path, help="Configuration file to be used by the application", default=DEFAULT_CONFIG_FILE)
-parser.add_argument('-o', '--output', type=Path, help="Which folder to copy backed up files", required=True)
-parser.add_argument('-v', '--verbose', help="Give more detail about what is happening", action='store_true')
-parser.add_argument('-g', '--git', help="Use git for snapshot", action='store_true')
+parser.add_argument('-o', '--output', type=Path, help="Which folder to copy backed up files, defaults to [cli] output")
+parser.add_argument('-v', '--verbose', help="Give more detail about what is happening", action='store_true', default=None)
+parser.add_argument('-g', '--git', help="Use git for snapshot", action='store_true', default=None)
+parser.add_argument('--git-commit-granularity', choices=['run', 'app', 'rule'], help="Make one git commit per run, per app or per rule, defaults to [cli] git_commit_granularity or run")
+parser.add_argument('--on-conflict', choices=['keep-both', 'newest', 'abort', 'ask'], help="When another machine changed a file this one also changed since it last copied or restored it, keep both, keep the newest, stop the run or ask which one to keep, also when restoring over newer files, defaults to [cli] on_conflict or newest")
+parser.add_argument('--follow-symlinks', choices=['never', 'safe'], help="Symlinks inside the folders of rules: never copies what they point to, safe follows the ones that don't point into the output or loop back to a folder above them, defaults to [cli] follow_symlinks or safe")
+parser.add_argument('--only-apps', help="Only load these apps, separated by commas, instead of [general] only_apps")
+parser.add_argument('--hostname', help="Name of this machine used to label snapshots, defaults to [general] hostname or the system hostname")
+parser.add_argument('--timeout', help="Stop starting new copies after this long, like 30m or 1h30m, the apps that were left out go first in the next run")
+parser.add_argument('--encrypt', help="Encrypt the files with age before they land in the output, using the recipients in [encryption]", action='store_true', default=None)
+parser.add_argument('--interval', help="Keep running, making a backup every this long, like 30m, for systems without cron")
+parser.add_argument('--log-format', choices=['text', 'json'], help="json writes one object per line with the level, the message and what was being processed, like app, rule, path and bytes, for Loki or Elastic, defaults to [cli] log_format or text")
+parser.add_argument('--progress', help="Show one line with the app being backed up, files and bytes per second and how long is left instead of each copy", action='store_true', default=None)
+parser.add_argument('--single-instance', help="Only one backup runs on this machine at a time, whatever output it is for, like scheduled tasks that start again before the previous one finished", action='store_true', default=None)
+parser.add_argument('--keep-awake', help="Ask the system not to sleep while the backup runs, so scheduled runs on laptops finish", action='store_true', default=None)
+parser.add_argument('--notify', help="Show a desktop notification when a backup is done with the apps updated, warnings and conflicts, or when it fails", action='store_true', default=None)
+parser.add_argument('--container', help="Running in a container, homes are looked for in the folders listed in [container] sources instead of [search]", action='store_true', default=None)
+
+# the flags that can be set in [cli] can be turned off for a run
+BOOLEAN_FLAGS = ['verbose', 'git', 'container', 'encrypt', 'progress', 'single_instance', 'keep_awake', 'notify']
+for flag in BOOLEAN_FLAGS:
+    parser.add_argument(f"--no-{flag.replace('_', '-')}", dest=flag, help=f"Don't use --{flag.replace('_', '-')}, even when [cli] {flag} is set", action='store_false', default=None)
+
+# without a command a backup is made
+subparsers = parser.add_subparsers(dest='command', metavar='command')
+
+show_diff_parser = subparsers.add_parser('show-diff', formatter_class=ArgumentDefaultsHelpFormatter, help="Show what changed in a backed up file between two git snapshots")
+show_diff_parser.add_argument('file', type=Path, help="File inside the output folder, like app/rule/file")
+show_diff_parser.add_argument('--from', dest='from_rev', help="Older snapshot, defaults to the previous commit that changed the file")
+show_diff_parser.add_argument('--to', dest='to_rev', help="Newer snapshot, defaults to the last commit that changed the file")
+
+history_parser = subparsers.add_parser('history', formatter_class=ArgumentDefaultsHelpFormatter, help="List the git snapshots that changed the files of an app, to pick one for restore --at")
+history_parser.add_argument('app', help="App to list the snapshots of")
+history_parser.add_argument('rule', nargs='?', help="Only the snapshots that changed this rule")
+history_parser.add_argument('--last', type=int, default=20, help="How many of the last snapshots to list")
+
+stats_parser = subparsers.add_parser('stats', formatter_class=ArgumentDefaultsHelpFormatter, help="Show statistics of the previous runs")
+stats_parser.add_argument('--last', type=int, default=10, help="How many of the last runs to list")
+
+sessions_parser = subparsers.add_parser('sessions', formatter_class=ArgumentDefaultsHelpFormatter, help="Show play sessions guessed from when the saves were written")
+sessions_parser.add_argument('apps', nargs='*', help="Apps to show, all if none is given")
+sessions_parser.add_argument('--last', type=int, default=5, help="How many of the last sessions of each app to list")
+
+activity_parser = subparsers.add_parser('activity', formatter_class=ArgumentDefaultsHelpFormatter, help="Show week by week when the saves of each app changed, from the play sessions and the git snapshots")
+activity_parser.add_argument('apps', nargs='*', help="Apps to show, all with sessions if none is given")
+activity_parser.add_argument('--weeks', type=int, default=8, help="How many of the last weeks to show")
+
+coverage_parser = subparsers.add_parser('coverage', formatter_class=ArgumentDefaultsHelpFormatter, help="Show which apps with rules were backed up on this machine, which seem installed but were not and which were never found")
+
+status_parser = subparsers.add_parser('status', formatter_class=ArgumentDefaultsHelpFormatter, help="Compare what is on this machine with the backup without copying anything")
+status_parser.add_argument('apps', nargs='*', help="Apps to check, all if none is given")
+status_parser.add_argument('--largest', type=int, default=0, help="List this many of the largest files of each rule, to find rules that match more than they should")
+
+verify_parser = subparsers.add_parser('verify', formatter_class=ArgumentDefaultsHelpFormatter, help="Read every backed up file again and compare it with the hash it had when it was copied, to find files a disk or a share corrupted")
+verify_parser.add_argument('apps', nargs='*', help="Apps to verify, all if none is given")
+
+analyze_parser = subparsers.add_parser('analyze', formatter_class=ArgumentDefaultsHelpFormatter, help="Find what takes the most space in the output and its history and suggest config keys to reclaim it")
+analyze_parser.add_argument('apps', nargs='*', help="Apps to analyze, all if none is given")
+analyze_parser.add_argument('--top', type=int, default=5, help="How many of the largest rules, versions and most changed files to list")
+
+watch_parser = subparsers.add_parser('watch', formatter_class=ArgumentDefaultsHelpFormatter, help="Keep running and back up each app as soon as its game exits, from the processes of its section")
+watch_parser.add_argument('apps', nargs='*', help="Apps to watch, all with processes set if none is given")
+watch_parser.add_argument('--every', default="5s", help="How often to look at the running processes")
+
+tui_parser = subparsers.add_parser('tui', formatter_class=ArgumentDefaultsHelpFormatter, help="Pick apps found on this machine and back up or restore them, seeing the output as it comes")
+tui_parser.add_argument('--controller', help="Keys a gamepad mapped by Steam Input can reach: d-pad moves, A (Enter) selects, X backs up, Y restores and B (Escape) quits", action='store_true')
+
+url_parser = subparsers.add_parser('url', formatter_class=ArgumentDefaultsHelpFormatter, help="Handle cloud-savegame:// links, so launchers like Steam in Game Mode can open the TUI or start a restore without a keyboard")
+url_subparsers = url_parser.add_subparsers(dest='url_command', metavar='action', required=True)
+url_register_parser = url_subparsers.add_parser('register', formatter_class=ArgumentDefaultsHelpFormatter, help="Make this configuration and output open cloud-savegame:// links of this user")
+url_open_parser = url_subparsers.add_parser('open', formatter_class=ArgumentDefaultsHelpFormatter, help="Open a link like cloud-savegame://restore/app, cloud-savegame://backup/app or cloud-savegame://status in the controller TUI")
+url_open_parser.add_argument('url', help="Link to open")
+
+list_apps_parser = subparsers.add_parser('list-apps', formatter_class=ArgumentDefaultsHelpFormatter, help="List the apps with rules, their rules and if they were found on this machine")
+list_apps_parser.add_argument('apps', nargs='*', help="Apps to list, all if none is given")
+
+config_parser = subparsers.add_parser('config', formatter_class=ArgumentDefaultsHelpFormatter, help="Read or change keys of the configuration file, keeping its comments, for scripts")
+config_subparsers = config_parser.add_subparsers(dest='config_command', metavar='action', required=True)
+config_get_parser = config_subparsers.add_parser('get', formatter_class=ArgumentDefaultsHelpFormatter, help="Print the value of a key, exiting with 1 when it is not set")
+config_get_parser.add_argument('key', help="section.key, like search.paths")
+config_set_parser = config_subparsers.add_parser('set', formatter_class=ArgumentDefaultsHelpFormatter, help="Set a key, adding the section when it doesn't exist")
+config_set_parser.add_argument('key', help="section.key, like minecraft.installdir")
+config_set_parser.add_argument('value', help="New value")
+config_unset_parser = config_subparsers.add_parser('unset', formatter_class=ArgumentDefaultsHelpFormatter, help="Remove a key")
+config_unset_parser.add_argument('key', help="section.key, like minecraft.installdir")
+
+gog_parser = subparsers.add_parser('gog', formatter_class=ArgumentDefaultsHelpFormatter, help="Back up the cloud saves GOG Galaxy keeps of each game")
+gog_subparsers = gog_parser.add_subparsers(dest='gog_command', metavar='action', required=True)
+gog_import_parser = gog_subparsers.add_parser('import', formatter_class=ArgumentDefaultsHelpFormatter, help="Find the cloud saves of GOG Galaxy of the installed games and set gog_client_id in the section of their apps, adding sections for games without rules")
+gog_import_parser.add_argument('-n', '--dry-run', help="Only list what would be imported", action='store_true')
+
+schema_parser = subparsers.add_parser('schema', formatter_class=ArgumentDefaultsHelpFormatter, help="Print the JSON Schema of the rules, the configuration or the runs in __meta__/runs.jsonl, for editors and other tools")
+schema_parser.add_argument('--what', choices=['rules', 'config', 'report'], default='config', help="Which format to describe")
+
+prune_parser = subparsers.add_parser('prune', formatter_class=ArgumentDefaultsHelpFormatter, help="Delete old versions of live files kept in __backup__ by restore")
+prune_parser.add_argument('--keep', help="How many of the newest versions to keep, like 5, or for how long to keep them, like 30d, defaults to [general] backup_retention")
+prune_parser.add_argument('-n', '--dry-run', help="Only list what would be deleted", action='store_true')
+
+restore_parser = subparsers.add_parser('restore', formatter_class=ArgumentDefaultsHelpFormatter, help="Copy backed up files back to where they were found")
+restore_parser.add_argument('apps', nargs='*', help="Apps to restore, all backed up apps if none is given")
+restore_parser.add_argument('--from-host', help="With the per_host layout, restore the saves of that machine instead of the ones of this one")
+restore_parser.add_argument('--at', help="Restore the saves as they were in this git snapshot, a commit listed by history, instead of the last ones")
+restore_parser.add_argument('--steam-account', help="Restore the saves kept in Steam userdata to this account, by account id, SteamID64, persona or account name, defaults to the account they were backed up from when it is on this machine")
+restore_parser.add_argument('--profile', help="With the per_user layout, restore the saves of that profile instead of the ones of this user")
+restore_parser.add_argument('--free-slots', help="Saves of games with slots go to free slots instead of overwriting local saves that are different", action='store_true')
+restore_parser.add_argument('-y', '--yes', help="Don't ask before overwriting files that are newer than the backup", action='store_true')
+
+for listing_parser in [history_parser, stats_parser, sessions_parser, status_parser, analyze_parser, verify_parser, list_apps_parser]:
+    listing_parser.add_argument('--format', default='table', help="table, json or a template filled for each row, like '{app} {bytes}', json shows the fields")
+
+merge_parser = subparsers.add_parser('merge', formatter_class=ArgumentDefaultsHelpFormatter, help="With the per_host layout, bring the saves of another machine to the folder of this one, the newest version of each file wins")
+merge_parser.add_argument('host', help="Machine whose folder is merged")
+merge_parser.add_argument('apps', nargs='*', help="Apps to merge, all if none is given")
+merge_parser.add_argument('-n', '--dry-run', help="Only list what would be merged", action='store_true')
+
+telemetry_parser = subparsers.add_parser('telemetry', formatter_class=ArgumentDefaultsHelpFormatter, help="Show, enable or disable the opt-in report of which apps with shipped rules are backed up on this machine")
+telemetry_parser.add_argument('action', choices=['status', 'enable', 'disable'], help="status shows exactly what would be sent")
+
+migrate_parser = subparsers.add_parser('migrate', formatter_class=ArgumentDefaultsHelpFormatter, help="Move the configuration and the identity of this machine to another one")
+migrate_subparsers = migrate_parser.add_subparsers(dest='migrate_command', metavar='action', required=True)
+migrate_export_parser = migrate_subparsers.add_parser('export', formatter_class=ArgumentDefaultsHelpFormatter, help="Bundle the configuration, the files it points to and the machine id")
+migrate_export_parser.add_argument('bundle', type=Path, help="Archive to create")
+migrate_import_parser = migrate_subparsers.add_parser('import', formatter_class=ArgumentDefaultsHelpFormatter, help="Put a bundle in place on this machine, the configuration is written to the -c path")
+migrate_import_parser.add_argument('bundle', type=Path, help="Archive created by migrate export")
+migrate_import_parser.add_argument('-y', '--yes', help="Don't ask, use this home and overwrite existing files", action='store_true')
+migrate_legacy_parser = migrate_subparsers.add_parser('legacy', formatter_class=ArgumentDefaultsHelpFormatter, help="Adopt an output made by older versions: hash the files it has and move the apps to the folder of the layout, committing with -g")
+migrate_legacy_parser.add_argument('-y', '--yes', help="Don't ask before moving the folders of the apps", action='store_true')
 
 args = parser.parse_args()
 
-assert args.config.is_file(), "Configuration file is not actually a file"
-assert args.output.is_dir() or not args.output.exists(), "Output folder is not actually a folder"
-if not args.output.exists():
-    args.output.mkdir(exist_ok=True, parents=True)
+# the configuration is what migrate import creates
+importing = args.command == "migrate" and args.migrate_command == "import"
+if getattr(args, 'bundle', None) is not None:
+    args.bundle = args.bundle.resolve()
+assert importing or args.config.is_file(), "Configuration file is not actually a file"
+args.config = args.config.resolve()
 
 config.read(args.config)
 
@@ -44,6 +172,38 @@ def get_str(section: str, key: str):
         return None
     return config[section][key]
 
+def get_bool(section: str, key: str):
+    return get_str(section, key) is not None
+
+def get_flag(section: str, key: str):
+    # flags of the command line can be turned off in the config too, unlike keys that are set to enable them
+    value = get_str(section, key)
+    if value is None:
+        return False
+    assert value.lower() in config.BOOLEAN_STATES, f"'{value}' is not a valid value for {key} in [{section}], use 1, yes, true or on to enable it and 0, no, false or off to disable it"
+    return config.getboolean(section, key)
+
+# flags can be set in the [cli] section so scheduled runs only need -c, the ones given in the command line win
+for flag in ['output', 'timeout', 'interval', 'git_commit_granularity', 'on_conflict', 'follow_symlinks', 'log_format']:
+    if getattr(args, flag) is None and get_str('cli', flag) is not None:
+        setattr(args, flag, get_str('cli', flag))
+for flag in BOOLEAN_FLAGS:
+    if getattr(args, flag) is None:
+        setattr(args, flag, get_flag('cli', flag))
+
+args.git_commit_granularity = args.git_commit_granularity or "run"
+args.on_conflict = args.on_conflict or "newest"
+args.follow_symlinks = args.follow_symlinks or "safe"
+args.log_format = args.log_format or "text"
+assert args.log_format in ['text', 'json'], f"unknown log_format '{args.log_format}', use text or json"
+assert args.follow_symlinks in ['never', 'safe'], f"unknown follow_symlinks '{args.follow_symlinks}', use never or safe"
+assert args.on_conflict in ['keep-both', 'newest', 'abort', 'ask'], f"unknown on_conflict '{args.on_conflict}', use keep-both, newest, abort or ask"
+assert args.git_commit_granularity in ['run', 'app', 'rule'], f"unknown git_commit_granularity '{args.git_commit_granularity}', use run, app or rule"
+assert args.output is not None, "Output folder is not set, use -o or [cli] output"
+args.output = Path(os.path.expanduser(args.output))
+assert args.output.is_dir() or not args.output.exists(), "Output folder is not actually a folder"
+args.output = args.output.resolve()
+
 def get_list(section: str, key: str):
     divider = get_str('general', 'divider')
     raw = get_str(section, key) or ''
@@ -59,76 +219,1139 @@ def get_paths(section: str, key: str):
         ret.append(Path(os.path.expanduser(p)).resolve())
     return ret
 
-def get_bool(section: str, key: str):
-    return get_str(section, key) is not None
+def get_mode(section: str, key: str):
+    raw = get_str(section, key)
+    if raw is None:
+        return None
+    return int(raw, 8)
+
+# save data is private by default, only the group can read it, 000 is a umask too
+output_umask = get_mode('output', 'umask')
+# what is restored to the homes gets the umask we were started with, like any other file the user writes
+user_umask = os.umask(0o027 if output_umask is None else output_umask)
+
+class as_user_umask:
+    def __enter__(self):
+        self.previous = os.umask(user_umask)
+    def __exit__(self, *exc):
+        os.umask(self.previous)
+
+def set_output_ownership(path: Path):
+    owner = get_str('output', 'owner')
+    group = get_str('output', 'group')
+    if owner is not None or group is not None:
+        from shutil import chown
+        chown(path, user=owner, group=group)
+
+def make_dirs(path: Path):
+    import stat
+    path = Path(path)
+    if path.is_dir():
+        return
+    make_dirs(path.parent)
+    path.mkdir(exist_ok=True)
+    dir_mode = get_mode('output', 'dir_mode')
+    if dir_mode is not None:
+        # the setgid bit of the parent is kept so the whole tree stays with the same group
+        os.chmod(path, dir_mode | (path.parent.stat().st_mode & stat.S_ISGID))
+    set_output_ownership(path)
+
+def set_file_mode(path: Path):
+    file_mode = get_mode('output', 'file_mode')
+    if file_mode is not None:
+        os.chmod(path, file_mode)
+    set_output_ownership(path)
+
+if not args.output.exists():
+    make_dirs(args.output)
+
+SIZE_UNITS = {"": 1, "K": 1024, "M": 1024**2, "G": 1024**3, "T": 1024**4}
+
+def parse_size(raw: str):
+    match = re.fullmatch(r'\s*([0-9.]+)\s*([KMGT]?)i?B?\s*', raw.upper())
+    assert match is not None, f"invalid size '{raw}', use something like 500M or 1G"
+    return int(float(match.group(1)) * SIZE_UNITS[match.group(2)])
+
+def get_size(section: str, key: str):
+    raw = get_str(section, key)
+    if raw is None:
+        return None
+    return parse_size(raw)
+
+DURATION_UNITS = {"s": 1, "m": 60, "h": 3600, "d": 86400}
+
+def parse_duration(raw: str):
+    raw = raw.strip().lower()
+    if re.fullmatch(r'[0-9.]+', raw):
+        return float(raw)
+    parts = re.findall(r'([0-9.]+)\s*([smhd])', raw)
+    assert len(parts) > 0 and re.fullmatch(r'(\s*[0-9.]+\s*[smhd])+\s*', raw), f"invalid duration '{raw}', use something like 90s, 30m or 1h30m"
+    return sum(float(amount) * DURATION_UNITS[unit] for amount, unit in parts)
+
+def format_duration(seconds: float):
+    hours, rest = divmod(int(seconds), 3600)
+    return f"{hours}h{rest // 60:02d}m" if hours > 0 else f"{rest // 60}m{rest % 60:02d}s"
+
+def get_duration(section: str, key: str):
+    raw = get_str(section, key)
+    if raw is None:
+        return None
+    return parse_duration(raw)
+
+def format_size(size: int):
+    for unit in ["", "K", "M", "G"]:
+        if size < 1024:
+            return f"{size:.0f}{unit}B" if unit == "" else f"{size:.1f}{unit}B"
+        size /= 1024
+    return f"{size:.1f}TB"
+
+# events integrators can subscribe to from plugins, callbacks receive keyword arguments
+# should_copy(source, destination): returning False skips the file
+# file_copied(source, destination, size)
+# rule_done(app, rule, path)
+# app_done(app)
+# warning(message)
+# commit_created(commit, message)
+# conflict(file, hostname, other_hostname, policy): another machine changed a file this one also changed
+# security(app, rule, path, reason, allowed): a rule tried to reach a file out of the folder it is about, allowed by the security mode or not
+run_stats = dict(bytes_copied=0, files_copied=0, files_checked=0, warnings=0, conflicts=0, files_unreadable=0, files_invalid=0)
+# files copied of each app in this run, for the hooks
+app_files_copied = {}
+# bytes copied and warnings of each app in this run, for the metrics
+app_bytes_copied = {}
+app_warnings = {}
+# what is worth telling in notifications, like first backups of an app and conflicts
+run_news = []
+
+hooks = dict(should_copy=[], file_copied=[], rule_done=[], app_done=[], warning=[], commit_created=[], conflict=[], security=[])
+
+def on(event: str, callback):
+    assert event in hooks, f"unknown event '{event}', available events: {', '.join(hooks)}"
+    hooks[event].append(callback)
+
+def emit(event: str, **kwargs):
+    results = []
+    for callback in list(hooks[event]):
+        results.append(run_callback(event, callback, kwargs))
+    stream_event(event, kwargs)
+    return results
+
+class PluginTimeout(Exception):
+    pass
+
+def describe_callback(callback):
+    code = getattr(callback, "__code__", None)
+    return f"{Path(code.co_filename).name}:{callback.__name__}" if code is not None else repr(callback)
+
+def run_callback(event: str, callback, kwargs: dict):
+    # a callback that fails or hangs is dropped instead of taking the run down, what it prints goes to plugins.jsonl in the state folder
+    import io
+    import json
+    import signal
+    import threading
+    from contextlib import redirect_stdout, redirect_stderr
+    timeout = get_duration('general', 'plugin_timeout') or 30
+    # the alarm only exists on unix and only interrupts the main thread
+    can_interrupt = hasattr(signal, "setitimer") and threading.current_thread() is threading.main_thread()
+    output = io.StringIO()
+    result = error = None
+    if can_interrupt:
+        def on_alarm(signum, frame):
+            raise PluginTimeout(f"took more than {format_duration(timeout)}")
+        previous_handler = signal.signal(signal.SIGALRM, on_alarm)
+        signal.setitimer(signal.ITIMER_REAL, timeout)
+    try:
+        with redirect_stdout(output), redirect_stderr(output):
+            result = callback(**kwargs)
+    except Exception as e:
+        error = f"{type(e).__name__}: {e}"
+    finally:
+        if can_interrupt:
+            signal.setitimer(signal.ITIMER_REAL, 0)
+            signal.signal(signal.SIGALRM, previous_handler)
+    if output.getvalue() != "":
+        debug(f"{describe_callback(callback)} printed: {output.getvalue().rstrip()}")
+    if output.getvalue() != "" or error is not None:
+        log_file = get_state_dir() / "plugins.jsonl"
+        log_file.parent.mkdir(exist_ok=True, parents=True)
+        with log_file.open('a') as log:
+            log.write(json.dumps(dict(time=format_timestamp(now()), callback=describe_callback(callback), event=event, output=output.getvalue(), error=error), sort_keys=True) + "\n")
+    if error is not None:
+        hooks[event].remove(callback)
+        message = f"the {event} callback {describe_callback(callback)} failed and won't be called again in this run: {error}"
+        # a failing warning callback would fail again for its own warning
+        if event == "warning":
+            print(f"Warning: {message}")
+        else:
+            warn(message)
+    return result
+
+def open_event_stream():
+    import socket
+    target = Path(os.path.expanduser(get_str('general', 'event_stream')))
+    if target.is_socket():
+        connection = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        connection.connect(str(target))
+        return connection.makefile('w')
+    # a fifo or a regular file
+    return target.open('a')
+
+def stream_event(event: str, kwargs: dict):
+    # every event but should_copy, that is asked for each file, is written as a json line for progress UIs and dashboards
+    import json
+    if event == "should_copy" or get_str('general', 'event_stream') is None:
+        return
+    if not hasattr(stream_event, "output"):
+        try:
+            stream_event.output = open_event_stream()
+        except OSError as e:
+            print(f"Warning: not streaming events: {e}")
+            stream_event.output = None
+    if stream_event.output is None:
+        return
+    try:
+        stream_event.output.write(json.dumps(dict(event=event, time=format_timestamp(now()), **kwargs), default=str) + "\n")
+        stream_event.output.flush()
+    except OSError as e:
+        # the consumer went away, the run goes on without it
+        print(f"Warning: stopped streaming events: {e}")
+        stream_event.output = None
+
+def sd_notify(*fields: str):
+    # under systemd, systemctl status shows the STATUS sent here, nothing is done when not run by a service
+    import socket
+    address = os.environ.get("NOTIFY_SOCKET")
+    if not address or not hasattr(socket, "AF_UNIX"):
+        return
+    if address.startswith("@"):
+        # abstract namespace socket
+        address = "\0" + address[1:]
+    try:
+        with socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM) as connection:
+            connection.sendto("\n".join(fields).encode(), address)
+    except OSError as e:
+        debug(f"Not notifying systemd: {e}")
+
+# what is being processed, prefixed to warnings and verbose messages so they can be told apart when they interleave
+log_context = {}
+
+class log_scope:
+    def __init__(self, **attrs):
+        self.attrs = {key: value for key, value in attrs.items() if value is not None}
+    def __enter__(self):
+        self.previous = dict(log_context)
+        log_context.update(self.attrs)
+    def __exit__(self, *exc):
+        log_context.clear()
+        log_context.update(self.previous)
+
+def format_log_context():
+    if len(log_context) == 0:
+        return ""
+    return "[" + " ".join(f"{key}={value}" for key, value in log_context.items()) + "] "
+
+def write_log_record(level: str, message: str, **attrs):
+    # one json object per line, the context and the attrs are fields so logs can be queried per app or rule
+    import json
+    from datetime import datetime
+    record = dict(time=datetime.now().astimezone().isoformat(timespec="milliseconds"), level=level, msg=message, **log_context)
+    record.update({key: value for key, value in attrs.items() if value is not None})
+    log_stream.write(json.dumps(record, default=str) + "\n")
+    log_stream.flush()
+
+# only what goes through info, debug and warn becomes json, what commands like schema or list-apps print is left as is
+log_stream = sys.stdout
+
+def info(message: str, depth=0, **attrs):
+    # messages that are always shown, attrs only go to json logs
+    if args.log_format == "json":
+        write_log_record("info", message, **attrs)
+    else:
+        print((" "*depth) + message)
+
+def debug(message: str, depth=0, **attrs):
+    if args.verbose:
+        clear_progress()
+        if args.log_format == "json":
+            write_log_record("debug", message, **attrs)
+        else:
+            print((" "*depth) + format_log_context() + message)
+
+def warn(message: str, depth=0, **attrs):
+    clear_progress()
+    if args.log_format == "json":
+        write_log_record("warning", message, **attrs)
+    else:
+        print((" "*depth) + format_log_context() + f"Warning: {message}")
+    run_stats["warnings"] += 1
+    app_warnings[current_app] = app_warnings.get(current_app, 0) + 1
+    emit("warning", message=message)
+
+# where the output folder can be mirrored to after each run, besides git push
+# each backend gets the output folder and the target from [remote] storage_target
+def mirror_rsync(output: Path, target: str):
+    return ["rsync", "-aH", "--delete", *[arg for name in MIRROR_EXCLUDES for arg in ["--exclude", f"/{name}"]], f"{output}/", target]
+
+def mirror_sftp(output: Path, target: str):
+    # sftp can't delete what is gone, files are only uploaded
+    # it has no exclusions either, so each entry of the output that isn't left out is put by itself
+    host, _, path = target.partition(":")
+    path = path or '.'
+    puts = [f'put -r "{item}" "{path}"' for item in sorted(output.iterdir()) if item.name not in MIRROR_EXCLUDES]
+    batch = "\n".join([f'-mkdir "{path}"', *puts]) + "\n"
+    return ["sftp", "-b", "-", host], batch
+
+def mirror_s3(output: Path, target: str):
+    command = ["aws", "s3", "sync", "--delete", *[arg for name in MIRROR_EXCLUDES for arg in ["--exclude", f"{name}/*"]], str(output), target]
+    if get_str('remote', 'storage_endpoint') is not None:
+        # S3 compatible services like MinIO, Backblaze B2 or Cloudflare R2
+        command.extend(["--endpoint-url", get_str('remote', 'storage_endpoint')])
+    return command
+
+def mirror_restic(output: Path, target: str):
+    # a snapshot of the output in an existing repository each run, the versions are kept by restic instead of or besides git
+    command = ["restic", "--repo", target, "backup", "--host", get_hostname(), "--tag", "cloud-savegame", *[arg for name in MIRROR_EXCLUDES for arg in ["--exclude", str(output / name)]], str(output)]
+    password_files = get_paths('remote', 'storage_password_file')
+    if len(password_files) > 0:
+        command[3:3] = ["--password-file", str(password_files[0])]
+    if get_str('remote', 'storage_password_command') is not None:
+        command[3:3] = ["--password-command", get_str('remote', 'storage_password_command')]
+    return command
+
+def mirror_borg(output: Path, target: str):
+    # like restic, the repository must exist, borg init is up to whoever picks its encryption
+    command = ["borg", "create", *[arg for name in MIRROR_EXCLUDES for arg in ["--exclude", str(output / name)]], f"{target}::cloud-savegame-{get_hostname()}-{{now:%Y-%m-%dT%H:%M:%S}}", str(output)]
+    env = {}
+    password_files = get_paths('remote', 'storage_password_file')
+    if len(password_files) > 0:
+        env["BORG_PASSPHRASE"] = password_files[0].read_text().strip()
+    if get_str('remote', 'storage_password_command') is not None:
+        env["BORG_PASSCOMMAND"] = get_str('remote', 'storage_password_command')
+    return command, None, env
+
+storage_backends = dict(rsync=mirror_rsync, sftp=mirror_sftp, s3=mirror_s3, restic=mirror_restic, borg=mirror_borg)
+
+def register_storage(name: str, backend):
+    # for plugins, backend(output, target) returns the command to run, (command, stdin) or (command, stdin, environment)
+    storage_backends[name] = backend
+
+def mirror_output():
+    # True when the output was mirrored
+    backend = get_str('remote', 'storage')
+    if backend is None:
+        return False
+    assert backend in storage_backends, f"unknown storage '{backend}', available: {', '.join(storage_backends)}"
+    target = get_str('remote', 'storage_target')
+    assert target is not None, f"storage={backend} needs storage_target in [remote]"
+    command = storage_backends[backend](args.output, target)
+    stdin = None
+    env = {}
+    if isinstance(command, tuple):
+        command, stdin, env = (*command, {}) if len(command) == 2 else command
+    info(f"Mirroring the output to '{target}' with {backend}")
+    if which(command[0]) is None:
+        warn(f"not mirroring: {command[0]} is not installed")
+        return False
+    debug(f"running {command}")
+    result = subprocess.run(command, input=stdin, text=True, capture_output=not args.verbose, env={**os.environ, **env})
+    if result.returncode != 0:
+        warn(f"mirroring with {backend} failed: {(result.stderr or '').strip()}")
+        return False
+    return True
+
+def load_plugins():
+    # plugins are python files that get the on function to register their callbacks
+    from runpy import run_path
+    for plugin in plugin_files:
+        assert plugin.is_file(), f"plugin '{plugin}' is not a file"
+        debug(f"loading plugin '{plugin}'")
+        run_path(str(plugin), init_globals=dict(on=on, register_storage=register_storage, register_format=register_format, register_notifier=register_notifier, args=args, config=config))
 
 # print(args)
 # print(config)
 
-if args.verbose:
-    print("parsed config file:")
-    pprint({section: dict(config[section]) for section in config.sections()})
-
 git_bin = which("git")
-def git(*params, always_show=False):
+
+class GitError(Exception):
+    pass
+
+# without git installed, like on a gaming PC sharing the config, snapshots are made by writing the objects, the index and
+# the refs the way git does, so git can take over the repo later, pulling, pushing and the history commands need git
+
+def native_git_dir():
+    git_dir = args.output / ".git"
+    if git_dir.is_file():
+        raise GitError("the output is a worktree of another repo, snapshots of it need git installed")
+    return git_dir
+
+def native_git_init():
+    git_dir = native_git_dir()
+    for folder in ["objects", "refs/heads", "refs/tags"]:
+        (git_dir / folder).mkdir(parents=True, exist_ok=True)
+    (git_dir / "HEAD").write_text("ref: refs/heads/master\n")
+    (git_dir / "config").write_text("\n".join([
+        "[core]",
+        "\trepositoryformatversion = 0",
+        f"\tfilemode = {'false' if sys.platform == 'win32' else 'true'}",
+        "\tbare = false",
+        "\tlogallrefupdates = true",
+    ]) + "\n")
+
+def native_git_object_path(sha: str):
+    return native_git_dir() / "objects" / sha[:2] / sha[2:]
+
+def native_git_write(kind: str, chunks, size: int):
+    # chunks is called twice, once for the hash and once to compress it if the object is new
+    import hashlib
+    import zlib
+    header = f"{kind} {size}\0".encode()
+    digest = hashlib.sha1(header)
+    for chunk in chunks():
+        digest.update(chunk)
+    sha = digest.hexdigest()
+    path = native_git_object_path(sha)
+    if not path.exists():
+        path.parent.mkdir(exist_ok=True)
+        temp = path.parent / f"tmp_obj_{sha[2:]}"
+        compressor = zlib.compressobj()
+        with temp.open('wb') as f:
+            f.write(compressor.compress(header))
+            for chunk in chunks():
+                f.write(compressor.compress(chunk))
+            f.write(compressor.flush())
+        os.replace(temp, path)
+    return sha
+
+def native_git_write_bytes(kind: str, data: bytes):
+    return native_git_write(kind, lambda: [data], len(data))
+
+def native_git_write_file(path: Path):
+    if path.is_symlink():
+        return native_git_write_bytes("blob", os.fsencode(os.readlink(path)))
+    def chunks():
+        with path.open('rb') as f:
+            yield from iter(lambda: f.read(1024 * 1024), b"")
+    return native_git_write("blob", chunks, path.stat().st_size)
+
+def native_git_read(sha: str):
+    # (kind, data), None for objects git packed
+    import zlib
+    path = native_git_object_path(sha)
+    if not path.exists():
+        return None
+    raw = zlib.decompress(path.read_bytes())
+    header, _, data = raw.partition(b"\0")
+    return header.split(b" ")[0].decode(), data
+
+def native_git_head_ref():
+    # the ref HEAD points to, None when it is detached
+    head = (native_git_dir() / "HEAD").read_text().strip()
+    return head[len("ref: "):] if head.startswith("ref: ") else None
+
+def native_git_head():
+    git_dir = native_git_dir()
+    ref = native_git_head_ref()
+    if ref is None:
+        return (git_dir / "HEAD").read_text().strip()
+    if (git_dir / ref).is_file():
+        return (git_dir / ref).read_text().strip()
+    packed_refs = git_dir / "packed-refs"
+    if packed_refs.is_file():
+        for line in packed_refs.read_text().splitlines():
+            sha, _, name = line.partition(" ")
+            if name == ref:
+                return sha
+    return None
+
+def native_git_read_index():
+    # {path: (sha, mode, stat key)}, stat key tells a file that didn't change without reading it again
+    import struct
+    index_file = native_git_dir() / "index"
+    if not index_file.exists():
+        return {}
+    data = index_file.read_bytes()
+    signature, version, count = struct.unpack(">4sII", data[:12])
+    if signature != b"DIRC" or version not in (2, 3):
+        raise GitError(f"the index of the output repo is version {version}, snapshots of it need git installed")
+    entries = {}
+    offset = 12
+    for _ in range(count):
+        fields = struct.unpack(">10I20sH", data[offset:offset + 62])
+        start = offset
+        offset += 62
+        if version == 3 and fields[11] & 0x4000:
+            offset += 2
+        end = data.index(b"\0", offset)
+        name = data[offset:end].decode('utf-8', 'surrogateescape')
+        offset = start + ((end - start) // 8 + 1) * 8
+        if (fields[11] >> 12) & 0x3 == 0:
+            entries[name] = (fields[10].hex(), fields[6], (fields[2], fields[3], fields[5], fields[9]))
+    return entries
+
+def native_git_write_index(entries: dict):
+    import hashlib
+    import struct
+    data = bytearray(struct.pack(">4sII", b"DIRC", 2, len(entries)))
+    names = sorted(entries, key=lambda name: name.encode('utf-8', 'surrogateescape'))
+    for name in names:
+        sha, mode, stat = entries[name]
+        encoded = name.encode('utf-8', 'surrogateescape')
+        mtime, mtime_ns, ino, size = stat
+        entry = struct.pack(">10I20sH", mtime, mtime_ns, mtime, mtime_ns, 0, ino, mode, 0, 0, size, bytes.fromhex(sha), min(len(encoded), 0xfff)) + encoded
+        data += entry + b"\0" * (8 - len(entry) % 8)
+    data += hashlib.sha1(data).digest()
+    temp = native_git_dir() / "index.lock"
+    temp.write_bytes(bytes(data))
+    os.replace(temp, native_git_dir() / "index")
+
+def native_git_ignore_rules(folder: Path, relative: str):
+    # (folder relative to the output, pattern, negated, only folders) of the .gitignore of a folder
+    rules = []
+    ignore_file = folder / ".gitignore"
+    if not ignore_file.is_file():
+        return rules
+    for line in ignore_file.read_text(errors='replace').splitlines():
+        pattern = line.rstrip()
+        if pattern == "" or pattern.startswith("#"):
+            continue
+        negated = pattern.startswith("!")
+        pattern = pattern.lstrip("!")
+        only_folders = pattern.endswith("/")
+        pattern = pattern.rstrip("/")
+        if pattern.startswith("**/"):
+            pattern = pattern[3:]
+        rules.append((relative, pattern, negated, only_folders))
+    return rules
+
+def native_git_is_ignored(path: str, is_folder: bool, rules: list):
+    from fnmatch import fnmatchcase
+    ignored = False
+    for base, pattern, negated, only_folders in rules:
+        if only_folders and not is_folder:
+            continue
+        relative = path[len(base) + 1:] if base != "" else path
+        # patterns with a slash are relative to the folder of their .gitignore, the others match the name anywhere below it
+        if fnmatchcase(relative, pattern.lstrip("/")) if "/" in pattern else fnmatchcase(relative.rpartition("/")[2], pattern):
+            ignored = not negated
+    return ignored
+
+def native_git_scan():
+    # what git add -A would put in the index, files that look like the index says are not read again
+    import stat
+    index = native_git_read_index()
+    entries = {}
+    def scan(folder: Path, relative: str, rules: list):
+        rules = rules + native_git_ignore_rules(folder, relative)
+        for item in sorted(os.scandir(folder), key=lambda item: item.name):
+            path = f"{relative}/{item.name}" if relative != "" else item.name
+            if path == ".git":
+                continue
+            info = item.stat(follow_symlinks=False)
+            if stat.S_ISDIR(info.st_mode):
+                # repos inside the output are not part of it
+                if not native_git_is_ignored(path, True, rules) and not os.path.lexists(os.path.join(item.path, ".git")):
+                    scan(Path(item.path), path, rules)
+                continue
+            if not (stat.S_ISREG(info.st_mode) or stat.S_ISLNK(info.st_mode)) or native_git_is_ignored(path, False, rules):
+                continue
+            if stat.S_ISLNK(info.st_mode):
+                mode = 0o120000
+            else:
+                mode = 0o100755 if info.st_mode & 0o100 and sys.platform != "win32" else 0o100644
+            key = (int(info.st_mtime) & 0xffffffff, info.st_mtime_ns % 1000000000, info.st_ino & 0xffffffff, info.st_size & 0xffffffff)
+            cached = index.get(path)
+            if cached is not None and cached[1] == mode and cached[2] == key:
+                entries[path] = cached
+            else:
+                entries[path] = (native_git_write_file(Path(item.path)), mode, key)
+    scan(args.output, "", [])
+    return entries
+
+def native_git_write_tree(entries: dict):
+    folders = {}
+    for name, (sha, mode, _) in entries.items():
+        folder, _, base = name.partition("/")
+        if base == "":
+            folders[folder] = (sha, mode)
+        else:
+            folders.setdefault(folder, {})[base] = (sha, mode, None)
+    data = b""
+    # git sorts folders as if their names ended with a slash
+    for name in sorted(folders, key=lambda name: name.encode('utf-8', 'surrogateescape') + (b"/" if isinstance(folders[name], dict) else b"")):
+        if isinstance(folders[name], dict):
+            sha, mode = native_git_write_tree(folders[name]), 0o40000
+        else:
+            sha, mode = folders[name]
+        data += f"{mode:o} ".encode() + name.encode('utf-8', 'surrogateescape') + b"\0" + bytes.fromhex(sha)
+    return native_git_write_bytes("tree", data)
+
+def native_git_head_tree():
+    head = native_git_head()
+    commit = native_git_read(head) if head is not None else None
+    if commit is None:
+        return None
+    return commit[1].split(b"\n")[0].split(b" ")[1].decode()
+
+def native_git_status():
+    # like git status --porcelain, the index is what the last snapshot had unless a run stopped between add and commit
+    index = native_git_read_index()
+    if len(index) > 0 and native_git_write_tree(index) != native_git_head_tree():
+        return [("M ", ".git/index")]
+    entries = native_git_scan()
+    status = [("??" if name not in index else " M", name) for name in sorted(entries) if entries[name][:2] != index.get(name, (None, None))[:2]]
+    status += [(" D", name) for name in sorted(index) if name not in entries]
+    return status
+
+def native_git_commit(message: str):
+    from datetime import datetime
+    index = native_git_read_index()
+    tree = native_git_write_tree(index)
+    parent = native_git_head()
+    if tree == native_git_head_tree():
+        return 1
+    lines = [f"tree {tree}"] + ([f"parent {parent}"] if parent is not None else [])
+    offset = int(datetime.now().astimezone().utcoffset().total_seconds()) // 60
+    when = f"{int(datetime.now().timestamp())} {'-' if offset < 0 else '+'}{abs(offset) // 60:02d}{abs(offset) % 60:02d}"
+    for role in ["author", "committer"]:
+        name = os.environ.get(f"GIT_{role.upper()}_NAME") or get_hostname()
+        email = os.environ.get(f"GIT_{role.upper()}_EMAIL") or f"cloud-savegame@{get_hostname()}"
+        lines.append(f"{role} {name} <{email}> {when}")
+    commit = native_git_write_bytes("commit", ("\n".join(lines) + f"\n\n{message}\n").encode())
+    ref = native_git_head_ref()
+    ref_file = native_git_dir() / (ref or "HEAD")
+    ref_file.parent.mkdir(parents=True, exist_ok=True)
+    temp = ref_file.with_name(ref_file.name + ".lock")
+    temp.write_text(commit + "\n")
+    os.replace(temp, ref_file)
+    return 0
+
+def native_git(*params):
+    # the few commands a backup runs
+    if params[:1] == ("init",):
+        native_git_init()
+        return 0
+    if params == ("add", "-A"):
+        native_git_write_index(native_git_scan())
+        return 0
+    if params[:2] == ("commit", "-m"):
+        return native_git_commit(params[2])
+    raise GitError(f"git {' '.join(params)} needs git installed")
+
+def git(*params, always_show=False, check=True):
     if args.git:
-        assert git_bin is not None, "git is not installed"
         kwargs=dict()
         if not (args.verbose or always_show):
             kwargs['stdout'] = subprocess.DEVNULL
             kwargs['stderr'] = subprocess.DEVNULL
-        print("git: %s" %(" ".join(map(lambda p: f"'{p}'", params))))
-        subprocess.call([git_bin, *params], **kwargs)
+        info("git: %s" %(" ".join(map(lambda p: f"'{p}'", params))))
+        returncode = subprocess.call([git_bin, *params], **kwargs) if git_bin is not None else native_git(*params)
+        if check and returncode != 0:
+            raise GitError(f"git {' '.join(params)} failed with exit code {returncode}")
+        return returncode
+
+def git_status():
+    # list of (status, path) from git status --porcelain
+    if git_bin is None:
+        return native_git_status()
+    status_result = subprocess.run([git_bin, 'status', '--porcelain', '--untracked-files=all'], capture_output=True, text=True)
+    if status_result.returncode != 0:
+        raise GitError(f"git status failed: {status_result.stderr.strip()}")
+    return [(line[:2], line[3:]) for line in status_result.stdout.splitlines() if line.strip() != ""]
 
 def git_is_repo_dirty():
-    status_result = subprocess.run(['git', 'status', '-s'], capture_output=True, text=True)
-    assert status_result.stdout is not None
-    return len(status_result.stdout) > 0
+    return len(git_status()) > 0
+
+def git_has_remote():
+    if git_bin is None:
+        config_file = native_git_dir() / "config"
+        if config_file.is_file() and '[remote "' in config_file.read_text() and not hasattr(git_has_remote, "warned"):
+            git_has_remote.warned = True
+            warn("the output repo has a remote, pulling and pushing need git installed, the snapshots stay on this machine")
+        return False
+    result = subprocess.run([git_bin, 'remote'], capture_output=True, text=True)
+    return result.returncode == 0 and result.stdout.strip() != ""
+
+# resolved before leaving the current folder, loaded once everything they can register to is defined
+plugin_files = get_paths('general', 'plugins')
 
+# where relative paths of the command line are relative to, for the runs of --interval
+launch_dir = os.getcwd()
 os.chdir(str(args.output))
 
-if args.git:
-    from subprocess import Popen
-    if not (args.output / ".git").exists():
-        git("init", "--initial-branch", "master")
-    is_repo_initially_dirty = git_is_repo_dirty()
-    if is_repo_initially_dirty:
-        git("add", "-A")
-        git("stash", "push")
-    git("pull")
-    if is_repo_initially_dirty:
-        git("stash", "pop")
+DIRTY_POLICIES = ["commit_as_is", "fail", "discard_untracked_meta_only"]
+
+def handle_dirty_repo():
+    # changes left in the output by someone else or by an interrupted run have to be dealt with before pulling
+    policy = get_str('git', 'dirty_policy') or "commit_as_is"
+    assert policy in DIRTY_POLICIES, f"invalid dirty_policy '{policy}', available: {', '.join(DIRTY_POLICIES)}"
+    dirty = git_status()
+    if len(dirty) == 0:
+        return
+    if policy == "commit_as_is":
         git("add", "-A")
         git("commit", "-m", "dirty repo state")
+        return
+    if policy == "discard_untracked_meta_only":
+        if all(status == "??" and path.startswith("__meta__/") for status, path in dirty):
+            for status, path in dirty:
+                info(f"Discarding untracked '{path}'")
+                (args.output / path).unlink()
+            return
+    dirty_list = "\n".join(f"  {status} {path}" for status, path in dirty)
+    raise GitError(f"the output repo has uncommitted changes and dirty_policy={policy}:\n{dirty_list}")
+
+def git_is_repo():
+    # .git may be a folder or, for worktrees, a file pointing to the real repo
+    if git_bin is None:
+        return (args.output / ".git").exists()
+    result = subprocess.run([git_bin, 'rev-parse', '--show-toplevel'], capture_output=True, text=True)
+    if result.returncode != 0:
+        return False
+    return Path(result.stdout.strip()).resolve() == args.output
+
+def abort_failed_pull():
+    # a pull stopped by conflicts leaves the markers in the output, the run would commit them
+    for operation, ref in [("merge", "MERGE_HEAD"), ("rebase", "REBASE_HEAD")]:
+        if subprocess.run([git_bin, 'rev-parse', '--quiet', '--verify', ref], capture_output=True).returncode == 0:
+            git(operation, "--abort", check=False)
+
+def prepare_git_repo():
+    if not args.git:
+        return
+    if git_bin is None:
+        debug("git is not installed, the snapshots are made without it")
+    if not git_is_repo():
+        bare_repo = get_paths('git', 'bare_repo')
+        if len(bare_repo) > 0:
+            if git_bin is None:
+                raise GitError("making the output a worktree of bare_repo needs git installed")
+            # the output becomes a worktree of a shared bare repo, like one in a NAS
+            branch = get_str('git', 'branch') or "master"
+            assert len(list(args.output.iterdir())) == 0, f"the output folder must be empty to become a worktree of '{bare_repo[0]}'"
+            git_dir = str(bare_repo[0])
+            has_branch = subprocess.run([git_bin, '--git-dir', git_dir, 'rev-parse', '--verify', '--quiet', f"refs/heads/{branch}"], capture_output=True).returncode == 0
+            if not has_branch:
+                # worktree add needs a commit to check out, so a new branch starts with an empty one
+                empty_tree = git_output('--git-dir', git_dir, 'hash-object', '-t', 'tree', '-w', '--stdin').decode().strip()
+                commit = git_output('--git-dir', git_dir, 'commit-tree', empty_tree, '-m', 'initial commit').decode().strip()
+                git("--git-dir", git_dir, "update-ref", f"refs/heads/{branch}", commit)
+            git("--git-dir", git_dir, "worktree", "add", str(args.output), branch)
+        else:
+            git("init", "--initial-branch", "master")
+    handle_dirty_repo()
+    if git_has_remote():
+        # offline, or a branch without upstream, the saves are still committed and pushed by a later run
+        if git("pull", check=False) != 0:
+            abort_failed_pull()
+            warn("pulling the output repo failed, backing up without the changes of the other machines")
+    else:
+        debug("Not pulling: the output repo has no remote")
+
+META_DIR = args.output / "__meta__"
+
+def load_meta(name: str, default):
+    import json
+    meta_file = META_DIR / name
+    if not meta_file.exists():
+        return default
+    return json.loads(meta_file.read_text())
+
+def save_meta(name: str, data):
+    import json
+    make_dirs(META_DIR)
+    (META_DIR / name).write_text(json.dumps(data, indent=2, sort_keys=True) + "\n")
+    set_file_mode(META_DIR / name)
+
+# bumped when the format of the meta files changes
+META_VERSION = 1
+
+def load_versioned_meta(name: str, default):
+    data = load_meta(name, default)
+    version = data.get("version", 0)
+    assert version <= META_VERSION, f"__meta__/{name} was written by a newer version of cloud-savegame (format {version}, this one knows {META_VERSION})"
+    data["version"] = META_VERSION
+    return data
+
+def now():
+    from datetime import datetime
+    # timestamps have the zone so they stay unambiguous across DST and timezone changes
+    return datetime.now().astimezone()
+
+def format_timestamp(timestamp):
+    return timestamp.isoformat(timespec="seconds")
+
+run_started = now()
+# durations are measured with the monotonic clock so clock adjustments during the run don't affect them
+run_started_monotonic = monotonic()
+
+def run_duration():
+    return round(monotonic() - run_started_monotonic, 3)
+
+def record_last_run():
+    last_runs = load_versioned_meta("last_run.json", dict(machines={}))
+    last_runs["machines"][get_machine_id()] = dict(
+        hostname=get_hostname(),
+        started=format_timestamp(run_started),
+        finished=format_timestamp(now()),
+        duration_seconds=run_duration(),
+    )
+    save_meta("last_run.json", last_runs)
+
+RUN_HISTORY = "runs.jsonl"
+
+def load_run_history():
+    import json
+    history_file = META_DIR / RUN_HISTORY
+    if not history_file.exists():
+        return []
+    return [json.loads(line) for line in history_file.read_text().splitlines() if line.strip() != ""]
+
+def run_summary():
+    unreadable = f", {run_stats['files_unreadable']} unreadable" if run_stats['files_unreadable'] > 0 else ""
+    unreadable += f", {run_stats['files_invalid']} failed validation" if run_stats['files_invalid'] > 0 else ""
+    return f"{run_stats['files_copied']} of {run_stats['files_checked']} files copied{unreadable}, {format_size(run_stats['bytes_copied'])} at {format_size(run_stats['bytes_copied'] / max(run_duration(), 0.001))}/s, {run_stats['warnings']} warnings in {format_duration(run_duration())}"
+
+# the app being backed up and how many of the rules of the run are done, for --progress
+progress = dict(app=None, rules_done=0, rules=0, shown=0)
+
+def show_progress(force=False):
+    # rewritten in place in a terminal, otherwise a line every few seconds so logs don't fill up
+    if not args.progress or progress["app"] is None:
+        return
+    interactive = sys.stderr.isatty()
+    if not (force and interactive) and monotonic() - progress["shown"] < (0.2 if interactive else 10):
+        return
+    progress["shown"] = monotonic()
+    elapsed = max(run_duration(), 0.001)
+    eta = "unknown"
+    if progress["rules_done"] > 0:
+        eta = format_duration(elapsed / progress["rules_done"] * (progress["rules"] - progress["rules_done"]))
+    line = f"{progress['app']}: {progress['rules_done']}/{progress['rules']} rules, {run_stats['files_copied']} of {run_stats['files_checked']} files copied, {run_stats['files_checked'] / elapsed:.1f} files/s, {format_size(run_stats['bytes_copied'] / elapsed)}/s, {eta} left"
+    if interactive:
+        from shutil import get_terminal_size
+        sys.stderr.write("\r\033[K" + line[:get_terminal_size().columns - 1])
+    else:
+        sys.stderr.write(line + "\n")
+    sys.stderr.flush()
+
+def clear_progress():
+    if args.progress and progress["app"] is not None and sys.stderr.isatty():
+        sys.stderr.write("\r\033[K")
+        sys.stderr.flush()
+
+def record_run_history(status: str):
+    import json
+    make_dirs(META_DIR)
+    run = dict(
+        version=META_VERSION,
+        machine_id=get_machine_id(),
+        hostname=get_hostname(),
+        started=format_timestamp(run_started),
+        duration_seconds=run_duration(),
+        bytes_copied=run_stats["bytes_copied"],
+        files_copied=run_stats["files_copied"],
+        files_checked=run_stats["files_checked"],
+        files_unreadable=run_stats["files_unreadable"],
+        files_invalid=run_stats["files_invalid"],
+        warnings=run_stats["warnings"],
+        apps=len(ingested_apps),
+        status=status,
+    )
+    with (META_DIR / RUN_HISTORY).open('a') as history:
+        history.write(json.dumps(run, sort_keys=True) + "\n")
+    set_file_mode(META_DIR / RUN_HISTORY)
+
+BACKUP_DIR = args.output / "__backup__"
+# (original, backup) of live files saved by backup_item in this run
+backed_up_items = []
+
+def backup_item(item: Path):
+    # keeps the current version of a live file or folder before something overwrites it
+    from datetime import datetime
+    from shutil import copy2, copytree
+    item = Path(item)
+    if not item.exists():
+        return None
+    if not hasattr(backup_item, "run_dir"):
+        backup_item.run_dir = BACKUP_DIR / datetime.now().strftime("%Y%m%d-%H%M%S")
+        make_dirs(BACKUP_DIR)
+        # live files of this machine are not part of the snapshots
+        (BACKUP_DIR / ".gitignore").write_text("*\n")
+    anchored = Path(*[part.replace(':', '').strip('\\/') for part in item.resolve().parts if part.strip('\\/') != ''])
+    destination = backup_item.run_dir / anchored
+    make_dirs(destination.parent)
+    if item.is_dir():
+        copytree(item, destination, symlinks=True, dirs_exist_ok=True)
+    else:
+        copy2(item, destination, follow_symlinks=False)
+    backed_up_items.append((item, destination))
+    debug(f"Backed up '{item}' to '{destination}'")
+    return destination
+
+def prune_backups(retention: str, dry_run=False):
+    # retention is a count of versions to keep or an age like 30d
+    from datetime import datetime
+    from shutil import rmtree
+    if not BACKUP_DIR.is_dir():
+        return
+    versions = []
+    for item in BACKUP_DIR.iterdir():
+        try:
+            versions.append((datetime.strptime(item.name, "%Y%m%d-%H%M%S"), item))
+        except ValueError:
+            continue
+    versions.sort(reverse=True)
+    if re.fullmatch(r'\s*[0-9]+\s*', retention):
+        old_versions = versions[int(retention):]
+    else:
+        max_age = parse_duration(retention)
+        old_versions = [(created, item) for created, item in versions if (datetime.now() - created).total_seconds() > max_age]
+    for created, item in old_versions:
+        if item == getattr(backup_item, "run_dir", None):
+            continue
+        if dry_run:
+            info(f"would delete '{item}'")
+            continue
+        debug(f"deleting '{item}'")
+        rmtree(item)
+    if not dry_run and len(old_versions) > 0:
+        info(f"Deleted {len(old_versions)} old versions from '{BACKUP_DIR}'")
+
+def prune():
+    retention = args.keep or get_str('general', 'backup_retention')
+    assert retention is not None, "how much to keep is not set, use --keep or [general] backup_retention"
+    prune_backups(retention, dry_run=args.dry_run)
+
+def print_undo_instructions():
+    if len(backed_up_items) == 0:
+        return
+    print(f"The previous versions of {len(backed_up_items)} items were kept in '{backup_item.run_dir}', to undo copy them back:")
+    for original, backup in backed_up_items:
+        print(f"  '{backup}' -> '{original}'")
+
+ingested_apps = set()
 
 apps = set()
 required_vars = {}
 var_users = {}
 all_vars = set()
+# rules that don't point to files, like registry keys, as (app, rule_name, kind, target)
+special_rules = []
+# rules without variables, as (app, rule_name, path, base), relative ones are anchored to [rules] relative_root
+plain_rules = []
+
+# rule paths starting with one of these words are handled by a specific ingester instead of copy_item
+SPECIAL_RULE_KINDS = ["reg", "plist", "browser"]
+# other words accepted for the same kinds
+SPECIAL_RULE_ALIASES = {"registry": "reg"}
+
+def parse_rule_kind(rule_path: str):
+    parts = rule_path.split(' ', 1)
+    kind = SPECIAL_RULE_ALIASES.get(parts[0], parts[0])
+    if len(parts) == 2 and kind in SPECIAL_RULE_KINDS:
+        return kind, parts[1].strip()
+    return None, rule_path
+
+# ludusavi placeholders that have an equivalent variable, paths with any other placeholder are skipped
+LUDUSAVI_PLACEHOLDERS = {
+    "<home>": "$home",
+    "<winAppData>": "$appdata/Roaming",
+    "<winLocalAppData>": "$appdata/Local",
+    "<winLocalAppDataLow>": "$appdata/LocalLow",
+    "<winDocuments>": "$documents",
+    "<xdgData>": "$xdg_data",
+    "<xdgConfig>": "$xdg_config",
+}
+LUDUSAVI_HIVES = {
+    "HKEY_CURRENT_USER": "HKCU",
+    "HKEY_LOCAL_MACHINE": "HKLM",
+}
+manifest_rules = {}
+# Steam app ids of the games of the manifest
+manifest_steam_ids = {}
+
+def ludusavi_app_name(game: str):
+    return re.sub('[^a-z0-9]+', '-', game.lower()).strip('-')
+
+def translate_ludusavi_path(path: str, install_dirs: list):
+    path = path.replace('\\', '/')
+    if path.startswith("<base>"):
+        bases = ["$installdir", *[f"$steamapps/common/{d}" for d in install_dirs]]
+        return [p for base in bases for p in translate_ludusavi_path(base + path[len("<base>"):], [])]
+    for placeholder, variable in LUDUSAVI_PLACEHOLDERS.items():
+        if path.startswith(placeholder):
+            path = variable + path[len(placeholder):]
+    if "<" in path or "*" in str(Path(path).parent) or not path.startswith("$"):
+        return []
+    return [path]
+
+def translate_ludusavi_game(game: str, info: dict):
+    lines = []
+    install_dirs = list((info.get('installDir') or {}).keys())
+    entries = [("files", translate_ludusavi_path(path, install_dirs), spec) for path, spec in (info.get('files') or {}).items()]
+    for key, spec in (info.get('registry') or {}).items():
+        hive, _, rest = key.replace('/', '\\').partition('\\')
+        if hive in LUDUSAVI_HIVES:
+            entries.append(("registry", [f"reg {LUDUSAVI_HIVES[hive]}\\{rest}"], spec))
+    counters = {}
+    for kind, paths, spec in entries:
+        if len(paths) == 0:
+            debug(f"ludusavi: skipping a path of '{game}' with placeholders or globs that can't be translated")
+            continue
+        tags = (spec or {}).get('tags') or []
+        rule_name = tags[0] if len(tags) > 0 else kind
+        # each manifest path is its own rule so files with the same name in different places don't overwrite each other
+        counters[rule_name] = counters.get(rule_name, 0) + 1
+        rule_name = f"{rule_name}{counters[rule_name]}"
+        for path in paths:
+            lines.append(f"{rule_name} {path}")
+    return lines
+
+def verify_rule_source(path: Path):
+    # rules decide what is read and where restore writes, with trusted_keys set rules from elsewhere need a minisign signature of one of them
+    keys = get_list('rules', 'trusted_keys')
+    if keys is None:
+        return True
+    signature = path.with_name(path.name + ".minisig")
+    if not signature.is_file():
+        warn(f"not loading '{path}': there is no signature '{signature.name}' next to it")
+        return False
+    assert which("minisign") is not None, "trusted_keys in [rules] needs minisign installed"
+    for key in keys:
+        # a key is the public key itself or a file with it
+        key_args = ["-p", os.path.expanduser(key)] if os.path.isfile(os.path.expanduser(key)) else ["-P", key]
+        result = subprocess.run(["minisign", "-V", "-q", "-m", str(path), "-x", str(signature), *key_args], capture_output=True)
+        if result.returncode == 0:
+            debug(f"'{path}' is signed by a trusted key")
+            return True
+    warn(f"not loading '{path}': it is not signed by any of the trusted_keys")
+    return False
+
+def load_ludusavi_manifests():
+    for manifest in get_paths('rules', 'ludusavi_manifest'):
+        if not verify_rule_source(manifest):
+            continue
+        try:
+            import yaml
+        except ImportError:
+            assert False, "reading ludusavi manifests needs PyYAML"
+        with manifest.open() as f:
+            data = yaml.safe_load(f) or {}
+        for game, info in data.items():
+            app = ludusavi_app_name(game)
+            # rules shipped with cloud-savegame are usually more precise than the generic manifest
+            if (RULES_DIR / f"{app}.txt").exists() or app in manifest_rules or not isinstance(info, dict):
+                continue
+            lines = translate_ludusavi_game(game, info)
+            if len(lines) > 0:
+                manifest_rules[app] = lines
+                if isinstance(info.get('steam'), dict) and info['steam'].get('id') is not None:
+                    manifest_steam_ids[app] = [str(info['steam']['id'])]
+        debug(f"loaded {len(manifest_rules)} games from the ludusavi manifest '{manifest}'")
+
+# rule apps with gog_client_id in their section get when no rule of theirs uses $gog_cloud
+GOG_CLOUD_RULE = "gog_cloud $gog_cloud"
+
+def get_rule_lines(app: str):
+    if app in manifest_rules:
+        lines = manifest_rules[app]
+    elif (RULES_DIR / f"{app}.txt").exists():
+        lines = (RULES_DIR / f"{app}.txt").read_text().split('\n')
+    else:
+        lines = []
+    if get_list(app, 'gog_client_id') is not None and not any("$gog_cloud" in line for line in lines):
+        # the cloud saves Galaxy mirrors are the same wherever the game keeps them, so any app can have them
+        lines = [*lines, GOG_CLOUD_RULE]
+    return lines
+
+# options that can follow the path of a rule, like saves $home/.game/saves archive=true exclude=*.bak, as the config key they
+# are the default of, the config wins when both have it
+RULE_OPTIONS = dict(archive="archive_{}", exclude="exclude_{}", type="type_{}", format="format_{}", slots="slots_{}", free_slots="free_slots_{}", transform="transform_{}", validate="validate_{}", platform=None)
+BOOLEAN_RULE_OPTIONS = ["archive", "free_slots"]
+# values of platform, as the sys.platform of each
+RULE_PLATFORMS = dict(linux="linux", windows="win32", macos="darwin")
+
+def split_rule_options(rule_path: str):
+    # paths can have spaces, so only key=value of known options at the end are options
+    parts = rule_path.split(' ')
+    options = {}
+    while len(parts) > 1:
+        match = re.fullmatch(r'([a-z_]+)=(\S*)', parts[-1])
+        if match is None or match.group(1) not in RULE_OPTIONS:
+            break
+        options[match.group(1)] = match.group(2)
+        parts.pop()
+    return " ".join(parts).strip(), options
+
+# (app, key) of the config keys that come from options of rule lines, which can come from manifests of anyone
+rule_line_options = set()
+
+def apply_rule_options(app: str):
+    for line in get_rule_lines(app):
+        parts = line.strip().split(' ', 1)
+        if len(parts) < 2:
+            continue
+        rule_path, options = split_rule_options(parts[1])
+        for option, value in options.items():
+            key = RULE_OPTIONS[option]
+            if key is None or option in BOOLEAN_RULE_OPTIONS and value.lower() not in ["true", "1", "yes"]:
+                continue
+            if not config.has_section(app):
+                config.add_section(app)
+            if not config.has_option(app, key.format(parts[0])):
+                config.set(app, key.format(parts[0]), value)
+                rule_line_options.add((app, key.format(parts[0])))
 
 def parse_rules(app: str):
-    for line in (RULES_DIR / f"{app}.txt").read_text().split('\n'):
+    for line in get_rule_lines(app):
         rule = line.strip()
         if len(rule) > 0:
             parts = rule.split(' ')
             rule_name = parts[0]
             if get_bool(app, f"ignore_{rule_name}"):
                 continue
-            rule_path = " ".join(parts[1:])
-            # print('rule', rule_name, rule_path)
-            yield rule_name.strip(), rule_path.strip()
+            rule_path, options = split_rule_options(" ".join(parts[1:]))
+            platform = options.get("platform")
+            if platform is not None:
+                assert platform in RULE_PLATFORMS, f"unknown platform '{platform}' in rule {rule_name} of {app}, available: {', '.join(RULE_PLATFORMS)}"
+                if sys.platform != RULE_PLATFORMS[platform]:
+                    continue
+            yield rule_name.strip(), rule_path
 
 # load rules
+def select_apps(app_names: list):
+    # apps left out here are never parsed, so they don't show up anywhere, not even in warnings
+    disabled = get_list('general', 'disable_apps') or []
+    only = args.only_apps.split(',') if args.only_apps else get_list('general', 'only_apps')
+    for app in [*disabled, *(only or [])]:
+        if app not in app_names:
+            warn(f"'{app}' in disable_apps or only_apps has no rules")
+    return [app for app in app_names if app not in disabled and (only is None or app in only)]
+
 rules_amount = 0
-for rulefile in RULES_DIR.glob('*.txt'):
-    appname = rulefile.stem
+load_ludusavi_manifests()
+# gog import adds sections for games that have no rules, their only rule is the one of the cloud saves
+gog_apps = [section for section in config.sections() if config.has_option(section, 'gog_client_id')]
+for appname in select_apps(sorted(set([*[rulefile.stem for rulefile in RULES_DIR.glob('*.txt')], *manifest_rules.keys(), *gog_apps]))):
     required_vars[appname] = set()
     apps.add(appname)
+    apply_rule_options(appname)
 
     for rule_name, rule_path in parse_rules(appname):
-        variables = list(re.match('\$([a-z]*)', rule_path).groups())
+        kind, target = parse_rule_kind(rule_path)
+        if kind is not None:
+            special_rules.append((appname, rule_name, kind, target))
+            rules_amount += 1
+            continue
+        variable_match = re.match('\$([a-z_]*)', rule_path)
+        variables = list(variable_match.groups()) if variable_match is not None else []
         if len(variables) == 0:
-            ingest_path(appname, rule_name, rule_path)
+            if Path(rule_path).is_absolute():
+                plain_rules.append((appname, rule_name, rule_path, None))
+            else:
+                relative_root = (get_paths('rules', 'relative_root') or [Path.home().resolve()])[0]
+                plain_rules.append((appname, rule_name, str(relative_root / rule_path), relative_root))
+            rules_amount += 1
             continue
         for var in variables:
             required_vars[appname].add(var)
@@ -138,120 +1361,4274 @@ for rulefile in RULES_DIR.glob('*.txt'):
             var_users[var].add(appname)
         rules_amount += 1
 
-if args.verbose:
-    print(f"loaded {rules_amount} rules for {len(apps)} apps")
-    print("all apps with rules loaded: ", apps)
-    print("all variables mentioned in rules: ", all_vars)
+debug("parsed config file:\n" + pformat({section: dict(config[section]) for section in config.sections()}))
 
-def copy_item(input_item, destination, depth=0):
-    from shutil import copyfile
-    input_item = Path(input_item)
-    destination = Path(destination)
-    if not input_item.exists():
+debug(f"loaded {rules_amount} rules for {len(apps)} apps")
+debug(f"all apps with rules loaded: {apps}")
+debug(f"all variables mentioned in rules: {all_vars}")
+
+SQLITE_HEADER = b"SQLite format 3\x00"
+SQLITE_SIDECAR_SUFFIXES = ["-wal", "-shm", "-journal"]
+
+def get_rule_type(app: str, rule_name: str):
+    return get_str(app, f"type_{Path(rule_name).parts[0]}") or "files"
+
+def is_sqlite_file(path: Path):
+    try:
+        with path.open('rb') as f:
+            return f.read(len(SQLITE_HEADER)) == SQLITE_HEADER
+    except OSError:
+        return False
+
+def is_sqlite_sidecar(path: Path):
+    for suffix in SQLITE_SIDECAR_SUFFIXES:
+        if path.name.endswith(suffix):
+            return (path.parent / path.name[:-len(suffix)]).exists()
+    return False
+
+def sqlite_mtime(path: Path):
+    mtime = path.stat().st_mtime
+    for suffix in SQLITE_SIDECAR_SUFFIXES:
+        sidecar = path.parent / (path.name + suffix)
+        if sidecar.exists():
+            mtime = max(mtime, sidecar.stat().st_mtime)
+    return mtime
+
+# (uid, gid, groups) used to read sources when running as root, so a user can't make root read files that user can't
+source_owner = None
+
+def set_source_owner(base: Path = None):
+    global source_owner
+    source_owner = None
+    if base is None:
         return
-    if str(input_item).startswith(str(args.output)):
-        if args.verbose:
-            print((""*depth) + f"Not copying '{input_item}': Origin is inside output")
+    if not hasattr(os, "geteuid") or os.geteuid() != 0:
         return
-    if input_item.is_file() or input_item.is_symlink():
-        destination.parent.mkdir(exist_ok=True, parents=True)
-        if destination.is_dir():
-            destination = destination / input_item.name
-        if destination.exists():
-            if (input_item.stat().st_mtime < destination.stat().st_mtime):
-                if args.verbose:
-                    print((""*depth) + f"Not copying '{input_item}': Didn't change")
-                return
-        print((" "*depth) + f"Copying '{input_item}' to '{destination}'")
-        copyfile(input_item, destination)
+    if get_bool('general', 'keep_root_privileges'):
         return
-    if input_item.is_dir():
-        destination.mkdir(exist_ok=True, parents=True)
-        for item in map(lambda x: x.name, input_item.iterdir()):
-            copy_item(input_item / item, destination / item, depth=depth+1)
+    import pwd
+    st = Path(base).stat()
+    try:
+        # the supplementary groups of root would let the owner read what only those groups can
+        groups = os.getgrouplist(pwd.getpwuid(st.st_uid).pw_name, st.st_gid)
+    except KeyError:
+        groups = [st.st_gid]
+    source_owner = (st.st_uid, st.st_gid, groups)
 
+class as_source_owner:
+    # can be nested, only the outermost one switches
+    depth = 0
+    def __enter__(self):
+        as_source_owner.depth += 1
+        if source_owner is not None and as_source_owner.depth == 1:
+            uid, gid, groups = source_owner
+            as_source_owner.previous_groups = os.getgroups()
+            os.setgroups(groups)
+            os.setegid(gid)
+            os.seteuid(uid)
+    def __exit__(self, *exc):
+        as_source_owner.depth -= 1
+        if source_owner is not None and as_source_owner.depth == 0:
+            os.seteuid(0)
+            os.setegid(0)
+            os.setgroups(as_source_owner.previous_groups)
 
-def ingest_path(app: str, rule_name: str, path: str):
-    path = str(path)
-    ppath = Path(path)
-    output_dir = args.output / app / rule_name
-    output_dir.mkdir(exist_ok=True, parents=True)
-    if "*" in path:
-        filename = ppath.name
-        parent = ppath.parent
-        assert "*" not in str(parent), f"globs in any path segment but the last are unsupported. This is a rule bug. app={app} rule_name={rule_name} path='{path}'"
-        if args.verbose:
-            print(f"glob ingest path='{path}'")
-        for item in parent.glob(filename):
-            new_rule_name = rule_name
-            if item.is_dir():
-                new_rule_name = str(Path(new_rule_name) / item.name)
-            ingest_path(app, new_rule_name, item)
-    elif ppath.exists():
-        if args.verbose:
-            print(f"ingest '{str(path)}' '{str(output_dir)}'")
-        copy_item(ppath, output_dir)
-        if args.git:
-            if git_is_repo_dirty():
-                commit = f"app={app} rule={rule_name} path={path}"
-                git("add", "-A")
-                git("commit", "-m", commit)
-
-for game in var_users['installdir']:
-    game_install_dirs = get_paths(game, 'installdir')
-    if game_install_dirs is None:
-        if get_str(game, 'not_installed') is None:
-            print(f"installdir missing for game {game}, please add it in the game configuration section or set anything to not_installed to disable this warning")
-        continue
-    for game_install_dir in game_install_dirs:
-        for rule_name, rule_path in parse_rules(game):
-            resolved_rule_path = rule_path.replace('$installdir', str(game_install_dir.resolve()))
-            if rule_path == resolved_rule_path:
-                continue
-            ingest_path(game, rule_name, resolved_rule_path)
+def open_source(path: Path):
+    with as_source_owner():
+        return open(path, 'rb')
 
-def get_homes():
-    extra_homes = get_paths('search', 'extra_homes')
-    if extra_homes is not None:
-        for home in extra_homes:
-            if not home.exists():
-                print(f"Warning: extra home '{str(home)}' does not exist")
-            else:
-                yield home
-    for search_path in get_paths('search', 'paths'):
-        for appdata in search_path.glob('**/AppData'):
-            yield appdata.parents[0]
+# magic bytes of things that are not saves but show up when a game update moves folders around
+SUSPICIOUS_MAGIC = {
+    b"MZ": "a Windows executable or installer",
+    b"\x7fELF": "a Linux executable",
+    b"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1": "an MSI installer",
+    b"MSCF": "a cabinet archive",
+    b"7z\xbc\xaf\x27\x1c": "a 7z archive",
+    b"Rar!": "a rar archive",
+    b"\x1aE\xdf\xa3": "a mkv or webm video",
+    b"BIK": "a bink video",
+    b"KB2": "a bink video",
+}
+SUSPICIOUS_SIZE = "100M"
 
-for homedir in get_homes():
-    if args.verbose:
-        print(f"Looking for stuff in {str(homedir)}")
-    appdata = homedir / "AppData"
-    for game in var_users.get('home') or []:
-        for rule_name, rule_path in parse_rules(game):
-            resolved_rule_path = rule_path.replace('$home', str(homedir.resolve()))
-            if rule_path == resolved_rule_path:
-                continue
-            ingest_path(game, rule_name, resolved_rule_path)
+def describe_suspicious(path: Path):
+    # None when the file looks like something a game would save
+    import math
+    size_limit = get_size('general', 'suspicious_size') or parse_size(SUSPICIOUS_SIZE)
+    if path.stat().st_size < size_limit:
+        return None
+    with open_source(path) as f:
+        sample = f.read(65536)
+    for magic, description in SUSPICIOUS_MAGIC.items():
+        if sample.startswith(magic):
+            return description
+    if sample[4:8] == b"ftyp" or sample[:4] == b"RIFF" and sample[8:12] == b"AVI ":
+        return "a video"
+    # compressed or encrypted data is close to 8 bits of entropy per byte, saves rarely are at this size
+    counts = [0] * 256
+    for byte in sample:
+        counts[byte] += 1
+    entropy = -sum(count / len(sample) * math.log2(count / len(sample)) for count in counts if count > 0)
+    if entropy > 7.99:
+        return "compressed data"
+    return None
 
-    for game in var_users['appdata']:
-        appdata = homedir / "AppData"
-        for rule_name, rule_path in parse_rules(game):
-            resolved_rule_path = rule_path.replace('$appdata', str(appdata.resolve()))
-            if rule_path == resolved_rule_path:
-                continue
-            ingest_path(game, rule_name, resolved_rule_path)
+# files being written to the output end with this until they are complete, a crash leaves them behind instead of a
+# truncated file that looks newer than its source, the next run deletes them
+TEMP_SUFFIX = ".cloud-savegame.tmp"
 
-    for documents_candidate in [ "Documentos", "Documents" ]:
-        documents = homedir / documents_candidate
-        if not documents.exists():
-            continue
-        for game in var_users['documents']:
-            for rule_name, rule_path in parse_rules(game):
-                resolved_rule_path = rule_path.replace('$documents', str(documents.resolve()))
-                if rule_path == resolved_rule_path:
-                    continue
-                ingest_path(game, rule_name, resolved_rule_path)
+def temp_path(destination: Path):
+    return destination.with_name(destination.name + TEMP_SUFFIX)
+
+class OutputError(Exception):
+    # writing to the output failed, like a full or read-only disk, every copy after this one would fail too
+    pass
+
+def write_output(operation, path: Path):
+    try:
+        return operation()
+    except OSError as e:
+        raise OutputError(f"writing '{path}' failed: {e}") from e
+
+def copy_file(input_item: Path, destination: Path):
+    # the source is opened with the privileges of its owner but written with ours
+    # the rename also keeps a hard link of staging to the published file from changing that one too
+    # only errors reading the source are OSErrors, those of the output are OutputErrors
+    partial = temp_path(destination)
+    try:
+        with open_source(input_item) as src:
+            dst = write_output(lambda: open(partial, 'wb'), partial)
+            try:
+                while True:
+                    chunk = src.read(1024 * 1024)
+                    if not chunk:
+                        break
+                    write_output(lambda: dst.write(chunk), partial)
+            finally:
+                write_output(dst.close, partial)
+    except BaseException:
+        if partial.exists():
+            partial.unlink()
+        raise
+    write_output(lambda: os.replace(partial, destination), destination)
+
+def remove_temp_files(root: Path):
+    # what an interrupted run was writing, the files they would replace are still the previous versions
+    for folder, folders, files in os.walk(root):
+        folders[:] = [name for name in folders if name != ".git"]
+        for name in files:
+            if name.endswith(TEMP_SUFFIX):
+                leftover = Path(folder) / name
+                warn(f"deleting '{leftover.relative_to(root)}', left behind by an interrupted run")
+                leftover.unlink()
+
+# with dedup in [output] each file is a hard link to the blob of its content in this folder, so the same save of many
+# machines or profiles takes the space of one, git stores content once already so the blobs are not committed
+BLOB_DIR = ".blobs"
+# left out of the mirrors: the files restore replaced, the blobs, which are the same content as the files linked to them, and
+# the history, which goes to the git remote
+MIRROR_EXCLUDES = ["__backup__", BLOB_DIR, ".git"]
+
+def dedup_file(path: Path, digest: str):
+    # the files of the output are only ever replaced, never written in place, so the files sharing a blob never change together
+    if not get_bool('output', 'dedup') or getattr(dedup_file, "unsupported", False):
+        return
+    algorithm, hexdigest = digest.split(":", 1)
+    blobs = args.output / BLOB_DIR
+    blob = blobs / algorithm / hexdigest[:2] / hexdigest
+    try:
+        if blob.exists() and os.path.samefile(blob, path):
+            return
+        if blob.exists() and blob.stat().st_size == path.stat().st_size:
+            partial = temp_path(path)
+            os.link(blob, partial)
+            os.replace(partial, path)
+            debug(f"'{path.relative_to(args.output)}' is the same as {blob.relative_to(args.output)}, linked to it")
+            return
+        if not blobs.exists():
+            make_dirs(blobs)
+            (blobs / ".gitignore").write_text("*\n")
+        make_dirs(blob.parent)
+        partial = temp_path(blob)
+        os.link(path, partial)
+        os.replace(partial, blob)
+    except OSError as e:
+        dedup_file.unsupported = True
+        warn(f"not deduplicating the output, hard links failed: {e}")
+
+def remove_orphan_blobs():
+    # a blob is of a content no file of the manifest has anymore, the link count can't tell, the published output and the
+    # staging copy link to every blob
+    blobs = args.output / BLOB_DIR
+    if not blobs.exists():
+        return
+    used = set(entry.get("hash") for entry in get_manifest().values())
+    removed = 0
+    for folder, folders, files in os.walk(blobs):
+        for name in files:
+            blob = Path(folder) / name
+            if name != ".gitignore" and f"{blob.relative_to(blobs).parts[0]}:{name}" not in used:
+                blob.unlink()
+                removed += 1
+    if removed > 0:
+        debug(f"Removed {removed} blobs of contents no file has anymore")
+
+def get_read_only_mount(path: Path):
+    # the mount point when the path is on a read-only filesystem, like the root of a Steam Deck or a mounted ISO
+    if not hasattr(os, "statvfs"):
+        return None
+    existing = Path(os.path.abspath(path))
+    while not existing.exists() and existing != existing.parent:
+        existing = existing.parent
+    def is_read_only(path: Path):
+        try:
+            return bool(os.statvfs(path).f_flag & os.ST_RDONLY)
+        except OSError:
+            return False
+    if not is_read_only(existing):
+        return None
+    # bind mounts are not told apart by ismount, the folder above is writable then
+    while not os.path.ismount(existing) and existing != existing.parent and is_read_only(existing.parent):
+        existing = existing.parent
+    return existing
+
+# filesystem types of network shares, reads there fail now and then when the connection hiccups
+NETWORK_FILESYSTEMS = {"nfs", "nfs4", "cifs", "smb3", "smbfs", "afpfs", "webdav", "davfs", "fuse.sshfs", "fuse.rclone", "9p", "ceph", "glusterfs", "fuse.glusterfs"}
+# errors that go away by trying again, like a stale NFS handle after the server restarted
+TRANSIENT_ERRNOS = {getattr(errno, name) for name in ["ESTALE", "EIO", "ETIMEDOUT", "EAGAIN", "ENOTCONN", "ECONNRESET", "ECONNABORTED", "EHOSTDOWN", "EHOSTUNREACH", "ENETRESET"] if hasattr(errno, name)}
+NETWORK_RETRIES = 4
+# (mount point, filesystem type) of each mount, longest first
+mount_table = None
+# network mounts that kept failing in this run, the files left there get only one try so a share that went away doesn't stall the run
+failing_network_mounts = set()
+
+def get_mount_table():
+    global mount_table
+    if mount_table is not None:
+        return mount_table
+    mount_table = []
+    if Path("/proc/self/mounts").is_file():
+        for line in Path("/proc/self/mounts").read_text().splitlines():
+            fields = line.split(" ")
+            if len(fields) >= 3:
+                # spaces and tabs in mount points come as octal escapes
+                mount_table.append((re.sub(r'\\([0-7]{3})', lambda match: chr(int(match.group(1), 8)), fields[1]), fields[2]))
+    elif sys.platform == "darwin":
+        output = subprocess.run(["mount"], stdout=subprocess.PIPE, stderr=subprocess.DEVNULL, text=True).stdout
+        for line in output.splitlines():
+            match = re.match(r'.* on (.*) \(([^,)]+)', line)
+            if match is not None:
+                mount_table.append((match.group(1), match.group(2)))
+    mount_table.sort(key=lambda mount: len(mount[0]), reverse=True)
+    return mount_table
+
+def get_network_mount(path: Path):
+    # the mount point or share when the path is on a network filesystem, like SMB or NFS
+    path = os.path.abspath(path)
+    if sys.platform == "win32":
+        import ctypes
+        drive = os.path.splitdrive(path)[0]
+        DRIVE_REMOTE = 4
+        if drive.startswith("\\\\") or ctypes.windll.kernel32.GetDriveTypeW(drive + "\\") == DRIVE_REMOTE:
+            return drive
+        return None
+    for mount_point, filesystem in get_mount_table():
+        if path == mount_point or path.startswith(mount_point.rstrip("/") + "/"):
+            return mount_point if filesystem in NETWORK_FILESYSTEMS else None
+    return None
+
+def retry_network_errors(operation, input_item: Path, depth=0):
+    # runs operation, trying again with backoff when the source is on a network share and the error is one that goes away
+    from time import sleep
+    network_mount = get_network_mount(input_item)
+    retries = int(get_str('general', 'network_retries') or NETWORK_RETRIES)
+    attempt = 0
+    while True:
+        try:
+            return operation()
+        except OSError as e:
+            if network_mount is None or network_mount in failing_network_mounts or e.errno not in TRANSIENT_ERRNOS:
+                raise
+            if attempt >= retries:
+                failing_network_mounts.add(network_mount)
+                raise
+            attempt += 1
+            debug(f"reading '{input_item}' from '{network_mount}' failed: {e}, trying again ({attempt}/{retries})", depth=depth)
+            sleep(2 ** (attempt - 1))
+
+def copy_sqlite(input_item: Path, destination: Path, depth=0):
+    import sqlite3
+    # a database the owner can't read fails like any other file
+    open_source(input_item).close()
+    tmp = temp_path(destination)
+    if tmp.exists():
+        tmp.unlink()
+    try:
+        # the backup API gives a consistent snapshot even if the database is mid-checkpoint
+        # sqlite can't open a database in WAL mode on a read-only filesystem without creating the -shm file, nothing
+        # can be writing to it there anyway
+        mode = "immutable=1" if get_read_only_mount(input_item) is not None else "mode=ro"
+        # sqlite opens the database and its -wal and -shm by itself, so the snapshot is read as the owner into memory and
+        # written to the output as us
+        snapshot = sqlite3.connect(":memory:")
+        try:
+            with as_source_owner():
+                src = sqlite3.connect(f"{input_item.as_uri()}?{mode}", uri=True)
+                try:
+                    src.backup(snapshot)
+                finally:
+                    src.close()
+            dst = sqlite3.connect(str(tmp))
+            try:
+                snapshot.backup(dst)
+            finally:
+                dst.close()
+        finally:
+            snapshot.close()
+    except sqlite3.Error as e:
+        if tmp.exists():
+            tmp.unlink()
+        wal = input_item.parent / (input_item.name + "-wal")
+        if wal.exists() and wal.stat().st_size > 0:
+            warn(f"not copying '{input_item}': sqlite backup failed ({e}) and there are uncheckpointed changes in '{wal.name}'", depth=depth)
+            return False
+        debug(f"sqlite backup of '{input_item}' failed ({e}), database is checkpointed so copying it raw", depth=depth)
+        copy_file(input_item, tmp)
+    tmp.replace(destination)
+    set_file_mode(destination)
+    return True
+
+TRANSFORMS = ["strip_paths", "normalize_eol", "canonicalize", "remap_paths"]
+
+def canonicalize_json(text: str):
+    import json
+    return json.dumps(json.loads(text), indent=2, sort_keys=True, ensure_ascii=False) + "\n"
+
+def canonicalize_ini(text: str):
+    # entries are sorted with the comments right above them, comments are kept
+    sections = []
+    header, entries, pending = None, [], []
+    for line in text.splitlines():
+        stripped = line.strip()
+        if stripped.startswith('[') and stripped.endswith(']'):
+            sections.append((header, entries, pending))
+            header, entries, pending = stripped, [], []
+        elif stripped.startswith(('#', ';')):
+            pending.append(stripped)
+        elif len(stripped) > 0:
+            key, sep, value = stripped.partition('=')
+            if sep == '':
+                key, sep, value = stripped.partition(':')
+            entry = f"{key.strip()}{sep}{value.strip()}" if sep else stripped
+            entries.append((key.strip().lower(), pending + [entry]))
+            pending = []
+    sections.append((header, entries, pending))
+    preamble = sections.pop(0)
+    output = []
+    for header, entries, pending in [preamble, *sorted(sections, key=lambda section: section[0])]:
+        if header is not None:
+            if len(output) > 0:
+                output.append("")
+            output.append(header)
+        # only by key, the order of repeated keys is kept since games read them as lists
+        for key, entry in sorted(entries, key=lambda entry: entry[0]):
+            output.extend(entry)
+        output.extend(pending)
+    return "\n".join(output) + "\n"
+
+def canonicalize_xml(text: str):
+    import xml.etree.ElementTree as ET
+    root = ET.fromstring(text, parser=ET.XMLParser(target=ET.TreeBuilder(insert_comments=True)))
+    for element in root.iter():
+        element.attrib = dict(sorted(element.attrib.items()))
+        if element.text is not None and element.text.strip() == "":
+            element.text = None
+        if element.tail is not None and element.tail.strip() == "":
+            element.tail = None
+    ET.indent(root)
+    return ET.tostring(root, encoding="unicode") + "\n"
+
+CANONICALIZERS = {
+    ".json": canonicalize_json,
+    ".ini": canonicalize_ini,
+    ".cfg": canonicalize_ini,
+    ".xml": canonicalize_xml,
+}
+
+def canonicalize(text: str, name: str):
+    # key order and formatting changes from games rewriting their config files become noise in git diffs
+    canonicalizer = CANONICALIZERS.get(Path(name).suffix.lower())
+    if canonicalizer is None:
+        return text
+    try:
+        return canonicalizer(text)
+    except Exception as e:
+        debug(f"not canonicalizing '{name}': {e}")
+        return text
+
+def get_transform(app: str, rule_name: str, variables: dict, reverse=False):
+    base_rule_name = Path(rule_name).parts[0]
+    transforms = get_list(app, f"transform_{base_rule_name}") or []
+    for transform in transforms:
+        assert transform in TRANSFORMS, f"unknown transform '{transform}' for app={app} rule={base_rule_name}, available: {', '.join(TRANSFORMS)}"
+    redact = get_str(app, f"redact_{base_rule_name}")
+    if reverse:
+        # path stripping can be undone and redacted values are taken back from the live file if there is one, line endings are lost
+        if "strip_paths" not in transforms and "remap_paths" not in transforms and redact is None:
+            return None
+        def reverse_transform(text: str, name: str, live: str = None):
+            if "strip_paths" in transforms:
+                for var, value in variables.items():
+                    text = substitute_variable(text, var, value)
+            if "remap_paths" in transforms:
+                text = remap_text(text)
+            if redact is not None and live is not None:
+                live_values = [match.group(1) if match.re.groups > 0 else match.group(0) for match in re.finditer(redact, live)]
+                parts = text.split("REDACTED")
+                text = parts[0]
+                for i, part in enumerate(parts[1:]):
+                    text += (live_values[i] if i < len(live_values) else "REDACTED") + part
+            return text
+        return reverse_transform
+    if len(transforms) == 0 and redact is None:
+        return None
+    def redact_match(match):
+        if match.re.groups == 0:
+            return "REDACTED"
+        start, end = match.span(1)
+        return match.group(0)[:start - match.start()] + "REDACTED" + match.group(0)[end - match.start():]
+    def transform(text: str, name: str, live: str = None):
+        if "strip_paths" in transforms:
+            # longest first so $appdata wins over $home when both match
+            for var, value in sorted(variables.items(), key=lambda item: -len(item[1])):
+                text = text.replace(value, f"${var}")
+        if "normalize_eol" in transforms:
+            text = text.replace("\r\n", "\n")
+        if redact is not None:
+            text = re.sub(redact, redact_match, text)
+        return text
+    # canonicalizing is only for telling changes apart, the output keeps the file the way the game wrote it
+    transform.canonicalize = "canonicalize" in transforms
+    return transform
+
+def same_canonical(input_item: Path, destination: Path, transform):
+    # the output already has this file when only the key order or the formatting changed
+    if args.encrypt or not destination.is_file():
+        return False
+    try:
+        with open_source(input_item) as f:
+            new = transform_bytes(f.read(), input_item.name, transform).decode('utf-8')
+        old = destination.read_bytes().decode('utf-8')
+    except (OSError, UnicodeDecodeError):
+        return False
+    return canonicalize(new, input_item.name) == canonicalize(old, input_item.name)
+
+def transform_bytes(data: bytes, name: str, transform, live: bytes = None):
+    if b"\0" in data[:8192]:
+        # transforms are for text files
+        return data
+    try:
+        text = data.decode('utf-8')
+        live_text = live.decode('utf-8') if live is not None else None
+    except UnicodeDecodeError:
+        return data
+    return transform(text, name, live=live_text).encode('utf-8')
+
+def apply_transform(path: Path, transform):
+    # True when the file changed
+    data = path.read_bytes()
+    transformed = transform_bytes(data, path.name, transform)
+    if transformed == data:
+        return False
+    path.write_bytes(transformed)
+    return True
+
+# app being ingested, used to account the time budgets
+current_app = None
+# seconds spent copying each app in this run
+app_times = {}
+# apps that didn't finish because the run or the app ran out of time
+skipped_apps = set()
+
+def is_out_of_time(app: str):
+    if app in skipped_apps:
+        return True
+    reason = None
+    if args.timeout is not None and monotonic() - run_started_monotonic > parse_duration(args.timeout):
+        reason = f"run timeout of {args.timeout}"
+    budget = get_duration(app, 'time_budget')
+    if budget is not None and app_times.get(app, 0) > budget:
+        reason = f"time budget of {get_str(app, 'time_budget')}"
+    if reason is None:
+        return False
+    warn(f"skipping the rest of {app}: {reason} exceeded")
+    skipped_apps.add(app)
+    return True
+
+class timing_app:
+    def __init__(self, app: str):
+        self.app = app
+    def __enter__(self):
+        global current_app
+        current_app = self.app
+        self.started = monotonic()
+    def __exit__(self, *exc):
+        app_times[self.app] = app_times.get(self.app, 0) + monotonic() - self.started
+
+# newest source modification time copied for each app in this run
+app_activity = {}
+
+def order_apps(apps):
+    # apps left out by a timeout in the previous run go first, then the ones whose saves changed most recently
+    from datetime import datetime
+    pending = set(load_meta("pending_apps.json", {}).get(get_machine_id(), []))
+    activity = {}
+    if get_str('general', 'order') != "name":
+        activity = load_meta("app_activity.json", {}).get(get_machine_id(), {})
+    def last_change(app):
+        if app not in activity:
+            return 0
+        return datetime.fromisoformat(activity[app]).timestamp()
+    return sorted(apps, key=lambda app: (app not in pending, -last_change(app), app))
+
+def save_app_activity():
+    from datetime import datetime
+    if len(app_activity) == 0:
+        return
+    activity = load_meta("app_activity.json", {})
+    machine_activity = activity.setdefault(get_machine_id(), {})
+    for app, mtime in app_activity.items():
+        machine_activity[app] = format_timestamp(datetime.fromtimestamp(mtime).astimezone())
+    save_meta("app_activity.json", activity)
+
+def save_coverage():
+    # when each app first and last had something backed up from this machine
+    coverage = load_meta("coverage.json", {})
+    machine_coverage = coverage.setdefault(get_machine_id(), {})
+    for app in sorted(ingested_apps):
+        if app not in machine_coverage:
+            info(f"First backup of {app} on this machine!")
+            run_news.append(f"first backup of {app} on this machine")
+            machine_coverage[app] = dict(first_seen=format_timestamp(run_started))
+        machine_coverage[app]["last_seen"] = format_timestamp(run_started)
+    save_meta("coverage.json", coverage)
+
+# how long after its last backup an app can be backed up again, on_change backs it up on every run where it changed
+SCHEDULES = dict(on_change=0, hourly=3600, daily=86400, weekly=7 * 86400)
+
+def get_app_schedule(app: str):
+    raw = get_str(app, 'schedule') or "on_change"
+    return SCHEDULES[raw] if raw in SCHEDULES else parse_duration(raw)
+
+def get_not_due_apps(apps):
+    # apps with a schedule backed up from this machine more recently than it, the ones named with --only-apps always run
+    from datetime import datetime
+    coverage = load_meta("coverage.json", {}).get(get_machine_id(), {})
+    named = args.only_apps.split(',') if args.only_apps else []
+    not_due = set()
+    for app in apps:
+        last_seen = coverage.get(app, {}).get("last_seen")
+        if app in named or last_seen is None or get_app_schedule(app) == 0:
+            continue
+        # a bit early is still on time, runs of cron or --interval don't start at the same second every time
+        if run_started.timestamp() - datetime.fromisoformat(last_seen).timestamp() < get_app_schedule(app) * 0.95:
+            not_due.add(app)
+    return not_due
+
+# modification times of the files copied in this run, sessions are guessed from them
+save_writes = {}
+SESSION_GAP = "30m"
+
+def save_sessions():
+    # writes closer than session_gap are the same play session, the session of the previous run goes on if the first write
+    # of this one is close enough to its end
+    from datetime import datetime
+    gap = get_duration('general', 'session_gap') or parse_duration(SESSION_GAP)
+    sessions = load_meta("sessions.json", {})
+    machine_sessions = sessions.setdefault(get_machine_id(), {})
+    for app, writes in save_writes.items():
+        app_sessions = machine_sessions.setdefault(app, [])
+        for write in sorted(writes):
+            last = app_sessions[-1] if len(app_sessions) > 0 else None
+            if last is not None and datetime.fromisoformat(last["start"]).timestamp() <= write <= datetime.fromisoformat(last["end"]).timestamp():
+                continue
+            if last is not None and 0 < write - datetime.fromisoformat(last["end"]).timestamp() <= gap:
+                last["end"] = format_timestamp(datetime.fromtimestamp(write).astimezone())
+                continue
+            timestamp = format_timestamp(datetime.fromtimestamp(write).astimezone())
+            app_sessions.append(dict(start=timestamp, end=timestamp))
+        # the first run of an app finds saves written long ago
+        app_sessions.sort(key=lambda session: datetime.fromisoformat(session["start"]).timestamp())
+    if len(save_writes) > 0:
+        save_meta("sessions.json", sessions)
+
+def save_pending_apps():
+    pending = load_meta("pending_apps.json", {})
+    if len(skipped_apps) == 0 and get_machine_id() not in pending:
+        return
+    if len(skipped_apps) > 0:
+        pending[get_machine_id()] = sorted(skipped_apps)
+        info(f"Out of time, these apps will go first in the next run: {', '.join(sorted(skipped_apps))}")
+    else:
+        pending.pop(get_machine_id())
+    save_meta("pending_apps.json", pending)
+
+CHANGE_DETECTION_MODES = ["mtime", "sha256", "blake2b"]
+
+def get_change_detection():
+    mode = get_str('general', 'change_detection') or "mtime"
+    assert mode in CHANGE_DETECTION_MODES, f"invalid change_detection '{mode}', available: {', '.join(CHANGE_DETECTION_MODES)}"
+    return mode
+
+def hash_file(path: Path, algorithm=None, source=False):
+    import hashlib
+    algorithm = algorithm or (get_change_detection() if get_change_detection() != "mtime" else "sha256")
+    digest = hashlib.new(algorithm)
+    with (open_source(path) if source else open(path, 'rb')) as f:
+        for chunk in iter(lambda: f.read(1024 * 1024), b""):
+            digest.update(chunk)
+    return f"{algorithm}:{digest.hexdigest()}"
+
+# hashes of what is in the output, keyed by the path relative to the output
+manifest = None
+
+def get_manifest():
+    global manifest
+    if manifest is None:
+        manifest = load_meta("manifest.json", {})
+    return manifest
+
+def save_manifest():
+    if manifest is not None:
+        save_meta("manifest.json", manifest)
+
+CONFLICT_LOG = "conflicts.jsonl"
+
+class ConflictError(Exception):
+    pass
+
+# copies of the version of a machine kept next to the file with keep-both, they are not saves of the game
+CONFLICT_INFIX = ".conflict-"
+
+def conflict_copy(destination: Path, hostname: str):
+    return destination.with_name(f"{destination.name}{CONFLICT_INFIX}{hostname}")
+
+def mark_synced(manifest_key: str, source_hash: str):
+    # this machine has the version of the output and its own file was source_hash then, it is a conflict only when both
+    # the output and the file of this machine changed since
+    entry = get_manifest().get(manifest_key)
+    if entry is not None:
+        entry.setdefault("seen", {})[get_machine_id()] = dict(hash=entry["hash"], source=source_hash)
+
+CONFLICT_DECISIONS = "conflict_decisions.json"
+# what was picked for whole rules in this run, by app/rule
+rule_decisions = {}
+
+def describe_version(version: dict):
+    from datetime import datetime
+    described = f"{version['hostname']}: {format_size(version['size'])}"
+    if version.get("mtime") is not None:
+        described += f", changed {format_timestamp(datetime.fromtimestamp(version['mtime']).astimezone())}"
+    save = {key: value for key, value in (version.get("save") or {}).items() if key not in ("format", "valid")}
+    if len(save) > 0:
+        described += ", " + ", ".join(f"{key}={value}" for key, value in sorted(save.items()))
+    return described
+
+def ask_conflict(key: str, rule, ours: dict, theirs: dict, both=True):
+    # ours or theirs is kept, both keeps the two, None when nobody can answer, picks are remembered for the same pair of versions
+    decisions = load_meta(CONFLICT_DECISIONS, {})
+    for decision in decisions.get(key, []):
+        if decision["ours"] == ours["hash"] and decision["theirs"] == theirs["hash"]:
+            info(f"'{key}' had this conflict before, keeping {decision['choice']} like then")
+            return decision["choice"]
+    choice = rule_decisions.get(rule)
+    if choice is None:
+        if not sys.stdin.isatty():
+            return None
+        clear_progress()
+        print(f"Conflict in '{key}':")
+        print(f"  ours   {describe_version(ours)}")
+        print(f"  theirs {describe_version(theirs)}")
+        answers = dict(o="ours", t="theirs", b="both") if both else dict(o="ours", t="theirs")
+        question = ("Keep [o]urs, [t]heirs or [b]oth" if both else "Keep [o]urs or [t]heirs") + (", in capitals for the rest of the rule" if rule is not None else "") + "? "
+        valid = set(answers) | ({answer.upper() for answer in answers} if rule is not None else set())
+        answer = None
+        while answer not in valid:
+            answer = input(question).strip()
+        choice = answers[answer.lower()]
+        if answer.isupper():
+            rule_decisions[rule] = choice
+    decisions.setdefault(key, []).append(dict(ours=ours["hash"], theirs=theirs["hash"], choice=choice, hostname=get_hostname(), time=format_timestamp(now())))
+    save_meta(CONFLICT_DECISIONS, decisions)
+    return choice
+
+def resolve_conflict(input_item: Path, destination: Path, manifest_key: str):
+    # where the file goes, None to not copy it, when another machine wrote it since this one last had it
+    import json
+    entry = get_manifest().get(manifest_key)
+    machine_id = get_machine_id()
+    if entry is None or entry.get("machine_id") in (None, machine_id):
+        return destination
+    synced = entry.get("seen", {}).get(machine_id)
+    if isinstance(synced, str):
+        # older manifests only had the version of the output
+        synced = dict(hash=synced, source=None)
+    if synced is not None and synced["hash"] == entry["hash"]:
+        return destination
+    source_hash = hash_file(input_item, source=True)
+    if source_hash in (entry["hash"], entry.get("source_hash")):
+        return destination
+    other = entry.get("hostname", entry["machine_id"])
+    if synced is not None and synced.get("source") == source_hash:
+        debug(f"Not copying '{input_item}': only {other} changed it since {get_hostname()} last synced")
+        return None
+    make_dirs(META_DIR)
+    with (META_DIR / CONFLICT_LOG).open('a') as log:
+        log.write(json.dumps(dict(time=format_timestamp(now()), file=manifest_key, machine_id=machine_id, hostname=get_hostname(), other_machine_id=entry["machine_id"], other_hostname=other, policy=args.on_conflict), sort_keys=True) + "\n")
+    set_file_mode(META_DIR / CONFLICT_LOG)
+    run_stats["conflicts"] += 1
+    emit("conflict", file=manifest_key, hostname=get_hostname(), other_hostname=other, policy=args.on_conflict)
+    message = f"{other} and {get_hostname()} both changed '{manifest_key}' since they last synced"
+    run_news.append(message)
+    if args.on_conflict == "ask":
+        try:
+            save = inspect_save(destination, input_item)
+        except OSError:
+            save = None
+        ours = dict(hostname=get_hostname(), size=input_item.stat().st_size, mtime=input_item.stat().st_mtime, hash=source_hash, save=save)
+        theirs = dict(hostname=other, size=entry.get("size") or 0, mtime=entry.get("mtime"), hash=entry["hash"], save=entry.get("save"))
+        choice = ask_conflict(manifest_key, "/".join(destination.relative_to(APPS_DIR).parts[:2]), ours, theirs)
+        if choice == "ours":
+            warn(f"{message}, the version of {get_hostname()} replaces it")
+            return destination
+        if choice == "theirs":
+            warn(f"{message}, the version of {other} is kept")
+            mark_synced(manifest_key, source_hash)
+            return None
+        if choice == "both":
+            mark_synced(manifest_key, source_hash)
+            destination = conflict_copy(destination, get_hostname())
+            warn(f"{message}, the version of {get_hostname()} goes to '{destination.name}'")
+            return destination
+        debug("Nobody to ask about the conflict, the newest version wins")
+    if args.on_conflict == "abort":
+        raise ConflictError(f"{message}, stopping because of --on-conflict abort")
+    # the version of the output is what this machine has from now on, so the same conflict isn't found again in the next run
+    if args.on_conflict == "keep-both":
+        mark_synced(manifest_key, source_hash)
+        destination = conflict_copy(destination, get_hostname())
+        warn(f"{message}, the version of {get_hostname()} goes to '{destination.name}'")
+        return destination
+    if input_item.stat().st_mtime > entry.get("mtime", 0):
+        warn(f"{message}, the version of {get_hostname()} is newer and replaces it")
+        return destination
+    warn(f"{message}, the version of {other} is newer and is kept")
+    mark_synced(manifest_key, source_hash)
+    return None
+
+NESTED_GIT_POLICIES = ["flatten", "skip", "rename"]
+# name a nested .git gets in the output with nested_git=rename
+NESTED_GIT_RENAMED = "_git"
+
+def get_nested_git_policy():
+    # a .git copied into the output repo would become an accidental submodule
+    policy = get_str('general', 'nested_git') or "flatten"
+    assert policy in NESTED_GIT_POLICIES, f"invalid nested_git '{policy}', available: {', '.join(NESTED_GIT_POLICIES)}"
+    return policy
+
+# files operating systems leave around that are not part of any save
+JUNK_FILES = ["Thumbs.db", "ehthumbs.db", "desktop.ini", ".DS_Store", ".directory"]
+
+def is_junk_file(path: Path):
+    if get_bool('general', 'keep_junk_files'):
+        return False
+    # ._ files are AppleDouble metadata macOS writes in filesystems without extended attributes
+    return path.name in JUNK_FILES or path.name.startswith("._")
+
+def is_excluded(app: str, destination: Path, is_dir=False):
+    # patterns match the end of the path inside the app folder, so *.log matches in any folder and cache/** matches cache folders
+    from fnmatch import fnmatch
+    if app is None:
+        return False
+    parts = destination.relative_to(APPS_DIR / app).parts
+    # the first part is the rule, exclude_<rule> only applies to it
+    patterns = (get_list(app, 'exclude') or []) + ((get_list(app, f"exclude_{parts[0]}") or []) if len(parts) > 0 else [])
+    for pattern in patterns:
+        if is_dir and pattern.endswith("/**"):
+            pattern = pattern[:-3]
+        for i in range(len(parts)):
+            if fnmatch("/".join(parts[i:]), pattern):
+                return True
+    return False
+
+def read_nbt(data: bytes):
+    # Minecraft's named binary tags, only what is needed to read level.dat
+    import struct
+    position = 0
+    def take(size):
+        nonlocal position
+        chunk = data[position:position+size]
+        assert len(chunk) == size, "truncated NBT"
+        position += size
+        return chunk
+    def read_string():
+        return take(struct.unpack(">H", take(2))[0]).decode(errors="replace")
+    def read_payload(tag):
+        if tag in (1, 2, 3, 4, 5, 6):
+            fmt = {1: ">b", 2: ">h", 3: ">i", 4: ">q", 5: ">f", 6: ">d"}[tag]
+            return struct.unpack(fmt, take(struct.calcsize(fmt)))[0]
+        if tag in (7, 11, 12):
+            length = struct.unpack(">i", take(4))[0]
+            take(length * {7: 1, 11: 4, 12: 8}[tag])
+            return None
+        if tag == 8:
+            return read_string()
+        if tag == 9:
+            item_tag = take(1)[0]
+            length = struct.unpack(">i", take(4))[0]
+            return [read_payload(item_tag) for _ in range(length)]
+        if tag == 10:
+            compound = {}
+            while True:
+                item_tag = take(1)[0]
+                if item_tag == 0:
+                    return compound
+                name = read_string()
+                compound[name] = read_payload(item_tag)
+        raise ValueError(f"unknown NBT tag {tag}")
+    assert take(1)[0] == 10, "NBT doesn't start with a compound"
+    read_string()
+    return read_payload(10)
+
+def inspect_minecraft_level(path: Path):
+    import gzip
+    data = read_nbt(gzip.decompress(path.read_bytes())).get("Data", {})
+    return dict(name=data.get("LevelName"), playtime_seconds=(data.get("Time") or 0) // 20, version=(data.get("Version") or {}).get("Name"))
+
+def inspect_rimworld_save(path: Path):
+    # the meta comes first, the whole file can have hundreds of megabytes
+    from xml.etree.ElementTree import iterparse
+    metadata = {}
+    for event, element in iterparse(path):
+        if element.tag == "gameVersion":
+            metadata["version"] = element.text
+        elif element.tag == "realPlayTimeInteracting":
+            metadata["playtime_seconds"] = int(float(element.text))
+            break
+    assert "version" in metadata, "not a RimWorld save"
+    return metadata
+
+def inspect_json(path: Path):
+    import json
+    json.loads(path.read_text())
+    return {}
+
+def inspect_xml(path: Path):
+    from xml.etree.ElementTree import parse
+    parse(path)
+    return {}
+
+def inspect_sqlite(path: Path):
+    import sqlite3
+    connection = sqlite3.connect(f"{path.as_uri()}?mode=ro", uri=True)
+    try:
+        result = connection.execute("PRAGMA quick_check").fetchone()[0]
+    finally:
+        connection.close()
+    assert result == "ok", result
+    return {}
+
+# formats of save files, a pattern of the file names they apply to and a function that raises if the file is broken
+# and returns what it could find out about the save, like its name and playtime
+SAVE_FORMATS = dict(
+    minecraft_level=("level.dat", inspect_minecraft_level),
+    rimworld_save=("*.rws", inspect_rimworld_save),
+    json=("*.json", inspect_json),
+    xml=("*.xml", inspect_xml),
+    sqlite=("*", inspect_sqlite),
+    gta_sa_save=("GTASAsf*.b", lambda path: {}),
+    gta_vc_save=("GTAVCsf*.b", lambda path: {}),
+)
+# formats of games with a fixed number of save slots, the name of each slot and how many there are
+SAVE_SLOTS = dict(
+    gta_sa_save=("GTASAsf{n}.b", 8),
+    gta_vc_save=("GTAVCsf{n}.b", 8),
+)
+# formats of the rules shipped with cloud-savegame, format_<rule> in the app section sets others
+DEFAULT_SAVE_FORMATS = {
+    ("minecraft", "saves"): "minecraft_level",
+    ("rimworld", "saves"): "rimworld_save",
+    ("grand-theft-auto-san-andreas", "saves"): "gta_sa_save",
+    ("grand-theft-auto-vice-city", "saves"): "gta_vc_save",
+}
+
+def get_rule_formats(app: str, rule_name: str):
+    rule_name = Path(rule_name).parts[0]
+    formats = get_list(app, f"format_{rule_name}")
+    if formats is None:
+        formats = [DEFAULT_SAVE_FORMATS[(app, rule_name)]] if (app, rule_name) in DEFAULT_SAVE_FORMATS else []
+    for name in formats:
+        assert name in SAVE_FORMATS, f"unknown format '{name}' for app={app} rule={rule_name}, available: {', '.join(SAVE_FORMATS)}"
+    return formats
+
+def get_rule_slots(app: str, rule_name: str):
+    # (name with {n}, count) from slots_<rule> in the app section, like save{n}.dat:10, or from the format
+    rule_name = Path(rule_name).parts[0]
+    raw = get_str(app, f"slots_{rule_name}")
+    if raw is not None:
+        template, _, count = raw.rpartition(":")
+        assert "{n}" in template and count.isdigit(), f"invalid slots_{rule_name} '{raw}', use something like save{{n}}.dat:10"
+        return template, int(count)
+    for name in get_rule_formats(app, rule_name):
+        if name in SAVE_SLOTS:
+            return SAVE_SLOTS[name]
+    return None
+
+def register_format(name: str, pattern: str, inspect, slots=None):
+    # for plugins, slots is (name with {n}, count) for games with save slots
+    if slots is not None:
+        SAVE_SLOTS[name] = slots
+    SAVE_FORMATS[name] = (pattern, inspect)
+
+def validate_sqlite(path: Path):
+    # unlike the quick_check of the sqlite format this reads every page and index
+    # immutable so a copy in WAL mode doesn't get -wal and -shm files next to it, nothing else has it open
+    import sqlite3
+    connection = sqlite3.connect(f"{path.as_uri()}?immutable=1", uri=True)
+    try:
+        result = connection.execute("PRAGMA integrity_check").fetchone()[0]
+    finally:
+        connection.close()
+    assert result == "ok", result
+
+def validate_zip(path: Path):
+    from zipfile import ZipFile
+    with ZipFile(path) as archive:
+        broken = archive.testzip()
+    assert broken is None, f"'{broken}' inside it is corrupted"
+
+def validate_gzip(path: Path):
+    import gzip
+    with gzip.open(path) as f:
+        while f.read(1024 * 1024):
+            pass
+
+# checks of copied files, validate_<rule> can also use the formats, anything else is a command
+VALIDATORS = dict(
+    sqlite=("*", validate_sqlite),
+    zip=("*.zip", validate_zip),
+    gzip=("*.gz", validate_gzip),
+)
+VALIDATION_TIMEOUT = "5m"
+
+# rules whose validate option was a command, warned once
+ignored_validations = set()
+
+def is_named_validation(validation: str):
+    return all(validator in VALIDATORS or validator in SAVE_FORMATS for validator in validation.split(get_str('general', 'divider')))
+
+def validate_copy(validation: str, name: str, path: Path):
+    # what is wrong with the copy at path of a file called name, None when it passed
+    import shlex
+    from fnmatch import fnmatch
+    validators = validation.split(get_str('general', 'divider'))
+    if is_named_validation(validation):
+        for validator in validators:
+            pattern, check = VALIDATORS.get(validator) or SAVE_FORMATS[validator]
+            if not fnmatch(name, pattern) or validator == "sqlite" and not is_sqlite_file(path):
+                continue
+            try:
+                check(path)
+            except Exception as e:
+                return f"{validator}: {e}"
+        return None
+    # a command gets the path where {path} is or at the end, exiting with anything but 0 fails the copy
+    command = validation.replace("{path}", shlex.quote(str(path))) if "{path}" in validation else f"{validation} {shlex.quote(str(path))}"
+    try:
+        result = subprocess.run(command, shell=True, capture_output=True, text=True, timeout=parse_duration(VALIDATION_TIMEOUT))
+    except subprocess.TimeoutExpired:
+        return f"'{validation}' took too long"
+    if result.returncode != 0:
+        return f"'{validation}' exited with {result.returncode}: {(result.stderr or result.stdout).strip()}"
+    return None
+
+def inspect_save(backup: Path, path: Path, depth=0):
+    # metadata for the manifest of the file at path, which is or goes to backup in the output, None if the rule has no
+    # format or the file is not one of its files
+    from fnmatch import fnmatch
+    # with the per_host and per_user layouts the apps are not at the top of the output
+    app, rule_name = backup.relative_to(APPS_DIR).parts[:2]
+    manifest_key = backup.relative_to(args.output).as_posix()
+    for name in get_rule_formats(app, rule_name):
+        pattern, inspect = SAVE_FORMATS[name]
+        if not fnmatch(path.name, pattern) or name == "sqlite" and not is_sqlite_file(path):
+            continue
+        try:
+            return dict(format=name, valid=True, **{key: value for key, value in inspect(path).items() if value is not None})
+        except Exception as e:
+            warn(f"'{manifest_key}' doesn't look like a valid {name} file, the save may be broken: {e}", depth=depth)
+            return dict(format=name, valid=False)
+    return None
+
+AGE_HEADER = b"age-encryption.org/v1"
+
+def encrypt_file(path: Path):
+    # the output is often pushed to remotes that are not that private, only who has the identity can read the files
+    if not args.encrypt:
+        return
+    assert which("age") is not None, "--encrypt needs age installed"
+    recipients = [f"--recipient={recipient}" for recipient in get_list('encryption', 'recipients') or []]
+    recipients += [f"--recipients-file={recipients_file}" for recipients_file in get_paths('encryption', 'recipients_file')]
+    assert len(recipients) > 0, "--encrypt needs recipients or recipients_file in [encryption]"
+    encrypted = path.with_name(path.name + ".age-tmp")
+    result = subprocess.run(["age", "--encrypt", *recipients, "--output", str(encrypted), str(path)], capture_output=True, text=True)
+    assert result.returncode == 0, f"failed to encrypt '{path}': {result.stderr.strip()}"
+    os.replace(encrypted, path)
+    set_file_mode(path)
+
+def decrypt_bytes(data: bytes):
+    # files that are not encrypted are returned as they are, so an output can have both
+    if not data.startswith(AGE_HEADER):
+        return data
+    identities = get_paths('encryption', 'identity')
+    assert len(identities) > 0, "the backup is encrypted, set identity in [encryption] to read it"
+    assert which("age") is not None, "the backup is encrypted and age is not installed"
+    result = subprocess.run(["age", "--decrypt", *[f"--identity={identity}" for identity in identities]], input=data, capture_output=True)
+    assert result.returncode == 0, f"failed to decrypt: {result.stderr.decode(errors='replace').strip()}"
+    return result.stdout
+
+class decrypted_file:
+    # path of a decrypted copy of a backed up file for tools that need a file, like reg import
+    def __init__(self, path: Path):
+        self.path = path
+    def __enter__(self):
+        from tempfile import NamedTemporaryFile
+        data = self.path.read_bytes()
+        if not data.startswith(AGE_HEADER):
+            self.temporary = None
+            return self.path
+        self.temporary = NamedTemporaryFile(suffix=self.path.suffix, delete=False)
+        self.temporary.write(decrypt_bytes(data))
+        self.temporary.close()
+        return Path(self.temporary.name)
+    def __exit__(self, *exc):
+        if self.temporary is not None:
+            os.unlink(self.temporary.name)
+
+def symlink_skip_reason(input_item: Path, visited: frozenset):
+    # why a symlink or a folder found inside a rule is not followed, visited are the folders above it, a link to one of them loops
+    if input_item.is_symlink():
+        if args.follow_symlinks == "never":
+            return "symlink, follow_symlinks=never"
+        if is_inside(input_item.resolve(), args.output.resolve()):
+            # the copies would be copied again on each level, growing until the disk is full
+            return "symlink into the output"
+    if input_item.is_dir():
+        stat = input_item.stat()
+        if (stat.st_dev, stat.st_ino) in visited:
+            return "symlink to a folder above it, following it would loop"
+    return None
+
+def skip_reason(input_item: Path, rule_type: str):
+    # why a file or folder is never copied, None if it is
+    if is_junk_file(input_item):
+        return "OS junk file"
+    if rule_type == "sqlite" and is_sqlite_sidecar(input_item):
+        return "sqlite sidecar file, handled by the database backup"
+    if str(input_item).startswith(str(args.output)):
+        return "Origin is inside output"
+    return None
+
+def is_up_to_date(input_item: Path, destination: Path, manifest_key: str, is_sqlite: bool, source_hash=None):
+    if not destination.exists():
+        return False
+    entry = get_manifest().get(manifest_key)
+    if entry is not None and entry.get("size") is not None and entry["size"] != destination.stat().st_size:
+        # cut short by something else, like a full disk or an older version without temp files
+        return False
+    if entry is not None and bool(entry.get("encrypted")) != bool(args.encrypt):
+        # copied before --encrypt was turned on or off
+        return False
+    if source_hash is not None:
+        return entry is not None and entry.get("source_hash") == source_hash
+    input_mtime = sqlite_mtime(input_item) if is_sqlite else input_item.stat().st_mtime
+    if get_bool('output', 'dedup') and not is_sqlite and entry is not None and entry.get("mtime") is not None:
+        # a deduplicated file has the modification time of its blob, from whichever copy of the content came first
+        return input_mtime <= entry["mtime"]
+    return input_mtime < destination.stat().st_mtime
+
+def copy_item(input_item, destination, depth=0, rule_type="files", transform=None, visited=frozenset()):
+    input_item = Path(input_item)
+    destination = Path(destination)
+    if not input_item.exists():
+        return
+    reason = skip_reason(input_item, rule_type) or symlink_skip_reason(input_item, visited)
+    if reason is not None:
+        debug(f"Not copying '{input_item}': {reason}", depth=depth)
+        return
+    if input_item.is_file():
+        if current_app is not None and is_out_of_time(current_app):
+            return
+        run_stats["files_checked"] += 1
+        show_progress()
+        # unlike suspicious_size this is checked for every file, even ones that were copied before
+        size_limit = get_size(current_app, 'max_file_size') if current_app is not None else None
+        size_limit = size_limit if size_limit is not None else get_size('general', 'max_file_size')
+        if size_limit and input_item.stat().st_size > size_limit:
+            warn(f"not copying '{input_item}': {format_size(input_item.stat().st_size)} is bigger than max_file_size={format_size(size_limit)}", depth=depth)
+            return
+        make_dirs(destination.parent)
+        if destination.is_dir():
+            destination = destination / input_item.name
+            if is_excluded(current_app, destination):
+                debug(f"Not copying '{input_item}': excluded", depth=depth)
+                return
+        is_sqlite = rule_type == "sqlite" and is_sqlite_file(input_item)
+        manifest_key = destination.relative_to(args.output).as_posix()
+        if not get_bool('general', 'keep_suspicious') and manifest_key not in get_manifest():
+            # only new files are checked, one that was already copied is not a surprise
+            try:
+                suspicious = describe_suspicious(input_item)
+            except OSError:
+                suspicious = None
+            if suspicious is not None:
+                warn(f"not copying '{input_item}': looks like {suspicious} of {format_size(input_item.stat().st_size)}, not a save, set keep_suspicious in [general] to copy it anyway", depth=depth)
+                return
+        source_hash = None
+        if get_change_detection() != "mtime" and not is_sqlite:
+            # timestamps can be preserved by whatever changed the file, the content can't lie
+            try:
+                source_hash = retry_network_errors(lambda: hash_file(input_item, source=True), input_item, depth=depth)
+            except PermissionError as e:
+                warn(f"not copying '{input_item}': {e}", depth=depth)
+                return
+            except OSError as e:
+                run_stats["files_unreadable"] += 1
+                warn(f"not copying '{input_item}', it couldn't be read: {e}", depth=depth)
+                return
+        if is_up_to_date(input_item, destination, manifest_key, is_sqlite, source_hash):
+            debug(f"Not copying '{input_item}': Didn't change", depth=depth)
+            entry = get_manifest().get(manifest_key)
+            if source_hash is not None and entry.get("seen", {}).get(get_machine_id()) != dict(hash=entry["hash"], source=source_hash):
+                # this machine has what the output has, even if another machine copied it
+                mark_synced(manifest_key, source_hash)
+            return
+        if transform is not None and transform.canonicalize and not is_sqlite and same_canonical(input_item, destination, transform):
+            debug(f"Not copying '{input_item}': Only the formatting changed", depth=depth)
+            entry = get_manifest().get(manifest_key)
+            if entry is not None:
+                entry["mtime"] = input_item.stat().st_mtime
+                entry["source_hash"] = source_hash
+                if source_hash is not None:
+                    mark_synced(manifest_key, source_hash)
+            return
+        destination = resolve_conflict(input_item, destination, manifest_key)
+        if destination is None:
+            return
+        manifest_key = destination.relative_to(args.output).as_posix()
+        if False in emit("should_copy", source=input_item, destination=destination):
+            debug(f"Not copying '{input_item}': Skipped by plugin", depth=depth)
+            return
+        if args.progress:
+            debug(f"Copying '{input_item}' to '{destination}'", depth=depth, path=input_item, destination=destination, bytes=input_item.stat().st_size)
+        else:
+            info(f"Copying '{input_item}' to '{destination}'", depth=depth, path=input_item, destination=destination, bytes=input_item.stat().st_size)
+        app, rule_name = destination.relative_to(APPS_DIR).parts[:2]
+        validation = get_str(app, f"validate_{rule_name}")
+        if validation is not None and (app, f"validate_{rule_name}") in rule_line_options and not is_named_validation(validation):
+            # a command in a rule line would run whatever a manifest says, only the config can have them
+            if (app, rule_name) not in ignored_validations:
+                ignored_validations.add((app, rule_name))
+                warn(f"ignoring validate={validation} of the rule {rule_name} of {app}: rules can only use {', '.join(sorted({*VALIDATORS, *SAVE_FORMATS}))}, commands go in validate_{rule_name} of the config", depth=depth)
+            validation = None
+        # with validation the copy goes next to the previous version, which is only replaced if the copy passes
+        copied = temp_path(destination.with_name(destination.name + ".validating")) if validation is not None else destination
+        if is_sqlite:
+            try:
+                if not copy_sqlite(input_item, copied, depth=depth):
+                    return
+            except PermissionError as e:
+                warn(f"not copying '{input_item}': {e}", depth=depth)
+                return
+        else:
+            try:
+                retry_network_errors(lambda: copy_file(input_item, copied), input_item, depth=depth)
+            except PermissionError as e:
+                warn(f"not copying '{input_item}': {e}", depth=depth)
+                return
+            except OSError as e:
+                run_stats["files_unreadable"] += 1
+                warn(f"not copying '{input_item}', it couldn't be read: {e}", depth=depth)
+                return
+        if validation is not None:
+            problem = validate_copy(validation, input_item.name, copied)
+            if problem is not None:
+                copied.unlink()
+                run_stats["files_invalid"] += 1
+                warn(f"not copying '{input_item}': the copy failed validation ({problem}), the previous version is kept", depth=depth)
+                return
+            os.replace(copied, destination)
+        if is_sqlite:
+            copied_hash = hash_file(input_item, source=True)
+        else:
+            set_file_mode(destination)
+            copied_hash = hash_file(destination)
+            if source_hash is not None and copied_hash != source_hash:
+                warn(f"the copy of '{input_item}' doesn't match the source, it probably changed while it was copied", depth=depth)
+        transformed = transform is not None and apply_transform(destination, transform)
+        save_info = inspect_save(destination, destination, depth=depth)
+        encrypt_file(destination)
+        # who wrote each file and the version each machine last had, to find conflicts between machines
+        get_manifest()[manifest_key] = dict(
+            source_hash=source_hash,
+            # the hash of the copy is the one of the output unless it was a database or it was transformed or encrypted
+            hash=copied_hash if not (is_sqlite or transformed or args.encrypt) else hash_file(destination),
+            size=destination.stat().st_size,
+            mtime=input_item.stat().st_mtime,
+            machine_id=get_machine_id(),
+            hostname=get_hostname(),
+            encrypted=bool(args.encrypt),
+            seen=get_manifest().get(manifest_key, {}).get("seen", {}),
+        )
+        mark_synced(manifest_key, copied_hash)
+        if save_info is not None:
+            get_manifest()[manifest_key]["save"] = save_info
+        if not is_sqlite:
+            # databases are compared by the time of their journal, a link to an older blob would look stale
+            dedup_file(destination, get_manifest()[manifest_key]["hash"])
+        size = destination.stat().st_size
+        if current_app is not None:
+            app_activity[current_app] = max(app_activity.get(current_app, 0), input_item.stat().st_mtime)
+            save_writes.setdefault(current_app, []).append(input_item.stat().st_mtime)
+        run_stats["bytes_copied"] += size
+        run_stats["files_copied"] += 1
+        app_files_copied[current_app] = app_files_copied.get(current_app, 0) + 1
+        app_bytes_copied[current_app] = app_bytes_copied.get(current_app, 0) + size
+        emit("file_copied", source=input_item, destination=destination, size=size)
+        return
+    if input_item.is_dir():
+        try:
+            with as_source_owner():
+                items = [x.name for x in input_item.iterdir()]
+        except PermissionError as e:
+            warn(f"not copying '{input_item}': {e}", depth=depth)
+            return
+        if ".git" in items:
+            policy = get_nested_git_policy()
+            if policy == "skip":
+                debug(f"Not copying '{input_item}': it's a git repo", depth=depth)
+                return
+            debug(f"'{input_item}' is a git repo, nested_git={policy}", depth=depth)
+        make_dirs(destination)
+        stat = input_item.stat()
+        visited = visited | {(stat.st_dev, stat.st_ino)}
+        for item in items:
+            item_destination = destination / item
+            if is_excluded(current_app, item_destination, is_dir=(input_item / item).is_dir()):
+                debug(f"Not copying '{input_item / item}': excluded", depth=depth+1)
+                continue
+            if item == ".git":
+                if get_nested_git_policy() == "flatten":
+                    continue
+                item_destination = destination / NESTED_GIT_RENAMED
+            copy_item(input_item / item, item_destination, depth=depth+1, rule_type=rule_type, transform=transform, visited=visited)
+
+
+def find_case_insensitive(path: Path):
+    # finds the real casing of a path, like studio/game on disk for a rule that says Studio/Game
+    path = Path(path)
+    if path.exists():
+        return path
+    current = Path(path.anchor)
+    for part in path.parts[1:] if path.anchor else path.parts:
+        candidate = current / part
+        if not candidate.exists():
+            if not current.is_dir():
+                return None
+            matches = [item for item in current.iterdir() if item.name.lower() == part.lower()]
+            if len(matches) == 0:
+                return None
+            candidate = matches[0]
+        current = candidate
+    return current
+
+def fix_path_case(app: str, path: str):
+    if "*" in Path(path).name:
+        parent = Path(path).parent
+        fixed = fix_path_case(app, str(parent))
+        return str(Path(fixed) / Path(path).name)
+    if Path(path).exists():
+        return path
+    if not (get_bool('general', 'ignore_case') or get_bool(app, 'ignore_case')):
+        return path
+    fixed = find_case_insensitive(Path(path))
+    if fixed is None:
+        return path
+    info(f"Using '{fixed}' for '{path}' of {app}: the case doesn't match")
+    return str(fixed)
+
+# rules that resolved to paths that don't exist in this run
+misses = []
+
+def record_miss(app: str, rule_name: str, path: str):
+    if app in manifest_rules:
+        # most games of the manifest are not installed, their misses would bury the ones of the shipped rules
+        return
+    # the deepest folder that exists tells if the game is not there at all or if the rule points to the wrong place
+    ppath = Path(path)
+    existing = ppath.parent
+    while not existing.exists() and existing != existing.parent:
+        existing = existing.parent
+    if "*" in ppath.name and ppath.parent.exists():
+        reason = "glob_matched_nothing"
+    elif existing == ppath.parent:
+        reason = "path_missing"
+    else:
+        reason = "parent_missing"
+    misses.append(dict(app=app, rule=rule_name, path=path, reason=reason, deepest_existing=str(existing)))
+    debug(f"miss path='{path}' reason={reason}")
+
+def save_misses():
+    all_misses = load_meta("misses.json", {})
+    all_misses[get_machine_id()] = sorted(misses, key=lambda miss: (miss["app"], miss["rule"], miss["path"]))
+    save_meta("misses.json", all_misses)
+    path_missing = len([miss for miss in misses if miss["reason"] != "parent_missing"])
+    parent_missing = len(misses) - path_missing
+    info(f"{len(misses)} rule paths didn't exist: {parent_missing} where even the folder above is missing (probably not installed), {path_missing} where only the last part is missing (the rule may be wrong), see __meta__/misses.json")
+
+def ingest_path(app: str, rule_name: str, path: str, variables: dict = {}, root: Path = None):
+    path = fix_path_case(app, str(path))
+    ppath = Path(path)
+    if app in blocked_apps or root is not None and not is_contained(app, rule_name, ppath, root):
+        return
+    output_dir = APPS_DIR / app / rule_name
+    if "*" in path:
+        filename = ppath.name
+        parent = ppath.parent
+        assert "*" not in str(parent), f"globs in any path segment but the last are unsupported. This is a rule bug. app={app} rule_name={rule_name} path='{path}'"
+        debug(f"glob ingest path='{path}'")
+        items = list(parent.glob(filename)) if parent.is_dir() else []
+        if len(items) == 0:
+            record_miss(app, rule_name, path)
+        for item in items:
+            make_dirs(output_dir)
+            new_rule_name = rule_name
+            if item.is_dir():
+                new_rule_name = str(Path(new_rule_name) / item.name)
+            ingest_path(app, new_rule_name, item, variables=variables, root=root)
+    elif ppath.exists():
+        if is_out_of_time(app):
+            return
+        debug(f"ingest '{str(path)}' '{str(output_dir)}'")
+        make_dirs(output_dir)
+        transform = get_transform(app, rule_name, variables)
+        with timing_app(app):
+            if ppath.is_dir() and is_archived(app, rule_name):
+                archive_item(app, rule_name, ppath, output_dir)
+            else:
+                copy_item(ppath, output_dir, rule_type=get_rule_type(app, rule_name), transform=transform)
+        finish_ingest(app, rule_name, path)
+    else:
+        record_miss(app, rule_name, path)
+
+# folders of rules with archive set are packed in this file inside the rule folder instead of copied file by file
+ARCHIVE_NAME = "_archive.tar.gz"
+
+class deterministic_tar:
+    # tar.gz whose bytes only depend on what is added: no timestamp or name in the gzip header and no owners in the entries,
+    # the order of the entries is up to the caller, so checksums of the same content match and remotes can dedup them
+    def __init__(self, fileobj):
+        self.fileobj = fileobj
+    def __enter__(self):
+        import gzip
+        import tarfile
+        self.compressed = gzip.GzipFile(filename="", mode='wb', fileobj=self.fileobj, mtime=0)
+        self.tar = tarfile.open(fileobj=self.compressed, mode='w', format=tarfile.GNU_FORMAT)
+        return self
+    def add(self, name: str, data, size: int, mtime=0, mode=0o644):
+        import tarfile
+        info = tarfile.TarInfo(name)
+        info.size = size
+        info.mtime = int(mtime)
+        info.mode = mode
+        self.tar.addfile(info, data)
+    def __exit__(self, *exc):
+        self.tar.close()
+        self.compressed.close()
+
+def is_archived(app: str, rule_name: str):
+    return get_bool(app, 'archive') or get_bool(app, f"archive_{Path(rule_name).parts[0]}")
+
+def newest_mtime(path: Path):
+    # deleting a file changes the modification time of its folder, so deletions count too
+    newest = path.stat().st_mtime
+    for root, dirs, files in os.walk(path):
+        for name in dirs + files:
+            try:
+                newest = max(newest, os.lstat(os.path.join(root, name)).st_mtime)
+            except OSError:
+                continue
+    return newest
+
+def archive_item(app: str, rule_name: str, input_item: Path, output_dir: Path):
+    # thousands of tiny files, like a Minecraft world, bloat git, one archive doesn't
+    # the archive only changes when a file changes, walk_copy gives the entries sorted and their mtimes are kept because
+    # games sort saves by them after a restore
+    archive = output_dir / ARCHIVE_NAME
+    with as_source_owner():
+        newest = newest_mtime(input_item)
+    entry = get_manifest().get(archive.relative_to(args.output).as_posix())
+    if get_bool('output', 'dedup') and entry is not None and entry.get("mtime") is not None:
+        up_to_date = archive.exists() and newest <= entry["mtime"]
+    else:
+        up_to_date = archive.exists() and newest < archive.stat().st_mtime
+    if entry is not None and bool(entry.get("encrypted")) != bool(args.encrypt):
+        up_to_date = False
+    if up_to_date:
+        debug(f"Not archiving '{input_item}': Didn't change")
+        return
+    info(f"Archiving '{input_item}' to '{archive}'", path=input_item, destination=archive)
+    partial = temp_path(archive)
+    with open(partial, 'wb') as raw, deterministic_tar(raw) as tar:
+        for source, destination in walk_copy(app, input_item, output_dir, rule_type=get_rule_type(app, rule_name)):
+            stat = source.stat()
+            with open_source(source) as f:
+                tar.add(destination.relative_to(output_dir).as_posix(), f, stat.st_size, mtime=stat.st_mtime, mode=stat.st_mode & 0o777)
+    os.replace(partial, archive)
+    set_file_mode(archive)
+    encrypt_file(archive)
+    size = archive.stat().st_size
+    get_manifest()[archive.relative_to(args.output).as_posix()] = dict(source_hash=None, hash=hash_file(archive), size=size, mtime=newest, encrypted=bool(args.encrypt))
+    dedup_file(archive, get_manifest()[archive.relative_to(args.output).as_posix()]["hash"])
+    app_activity[app] = max(app_activity.get(app, 0), newest)
+    save_writes.setdefault(app, []).append(newest)
+    run_stats["bytes_copied"] += size
+    run_stats["files_copied"] += 1
+    app_files_copied[app] = app_files_copied.get(app, 0) + 1
+    app_bytes_copied[app] = app_bytes_copied.get(app, 0) + size
+    emit("file_copied", source=input_item, destination=archive, size=size)
+
+def finish_ingest(app: str, rule_name: str, path: str):
+    ingested_apps.add(app)
+    emit("rule_done", app=app, rule=rule_name, path=path)
+    if args.git_commit_granularity == "rule":
+        git_commit_if_dirty(f"app={app} rule={rule_name} path={path}")
+
+def get_hostname():
+    import socket
+    return args.hostname or get_str('general', 'hostname') or socket.gethostname()
+
+# shared puts the apps in the output folder, so machines share their saves, per_host gives each machine its own folder
+# in the output, named after the hostname, so they never overwrite each other and merge brings saves of one to another
+# per_user gives each profile its own folder, so people sharing the output only back up and restore their own saves
+OUTPUT_LAYOUTS = ["shared", "per_host", "per_user"]
+
+def get_output_layout():
+    layout = get_str('output', 'layout') or "shared"
+    assert layout in OUTPUT_LAYOUTS, f"invalid layout '{layout}', available: {', '.join(OUTPUT_LAYOUTS)}"
+    return layout
+
+def get_host_dir(hostname: str):
+    return args.output / hostname if get_output_layout() == "per_host" else args.output
+
+def get_profile():
+    # the [household] section maps OS users and Steam accounts to profiles, unmapped users are their own profile
+    import getpass
+    user = getpass.getuser()
+    return get_str('household', user.lower()) or user
+
+def get_home_profile(homedir: Path):
+    # homes inside other homes, like the users of wine prefixes, are of the profile of the outer home
+    profile = get_str('household', homedir.name.lower())
+    if profile is not None:
+        return profile
+    if homedir.resolve() == Path.home().resolve():
+        return get_profile()
+    for outer in [Path.home(), *get_base_homes()]:
+        if outer.resolve() in homedir.resolve().parents:
+            return get_home_profile(outer)
+    return homedir.name
+
+def get_apps_dir():
+    if get_output_layout() == "per_user":
+        return args.output / (getattr(args, 'profile', None) or get_profile())
+    return get_host_dir(getattr(args, 'from_host', None) or get_hostname())
+
+# where the folders of the apps are, restore --from-host and --profile read the ones of another machine or profile
+APPS_DIR = get_apps_dir()
+
+def get_state_dir():
+    state_home = os.environ.get("XDG_STATE_HOME") or os.path.expanduser("~/.local/state")
+    return Path(state_home) / "cloud-savegame"
+
+def get_machine_id():
+    # the hostname changes when machines are renamed, the machine id doesn't
+    machine_id = get_str('general', 'machine_id')
+    if machine_id is not None:
+        return machine_id
+    if hasattr(get_machine_id, "cached"):
+        return get_machine_id.cached
+    from uuid import uuid4
+    machine_id_file = get_state_dir() / "machine_id"
+    try:
+        if not machine_id_file.exists():
+            machine_id_file.parent.mkdir(exist_ok=True, parents=True)
+            machine_id_file.write_text(str(uuid4()) + "\n")
+        get_machine_id.cached = machine_id_file.read_text().strip()
+    except OSError as e:
+        warn(f"can't store the machine id in '{machine_id_file}', set machine_id in the config: {e}")
+        get_machine_id.cached = get_hostname()
+    return get_machine_id.cached
+
+def register_machine():
+    # __meta__/machines.json has the names each machine had, entries keyed by hostname from before machine ids are merged
+    machines = load_meta("machines.json", {})
+    machine_id = get_machine_id()
+    hostname = get_hostname()
+    entry = machines.get(machine_id, dict(hostnames=[]))
+    if hostname in machines and hostname != machine_id:
+        legacy = machines.pop(hostname)
+        debug(f"merging machine entry of hostname '{hostname}' into machine id '{machine_id}'")
+        for name in legacy.get("hostnames", [hostname]):
+            if name not in entry["hostnames"]:
+                entry["hostnames"].append(name)
+    if hostname not in entry["hostnames"]:
+        entry["hostnames"].append(hostname)
+    entry["hostname"] = hostname
+    machines[machine_id] = entry
+    save_meta("machines.json", machines)
+
+def git_commit_if_dirty(message: str):
+    message = f"{message} host={get_hostname()} machine={get_machine_id()}"
+    if args.git:
+        if git_is_repo_dirty():
+            git("add", "-A")
+            git("commit", "-m", message)
+            emit("commit_created", commit=git_output("rev-parse", "HEAD").decode().strip() if git_bin is not None else native_git_head(), message=message)
+
+def registry_key_filename(key: str):
+    return re.sub(r'[^A-Za-z0-9_.-]+', '_', key).strip('_') + ".reg"
+
+def ingest_registry(app: str, rule_name: str, key: str):
+    # registry keys only exist on Windows, the reg tool ships with it
+    if sys.platform != "win32":
+        debug(f"Not exporting registry key '{key}': not running on Windows")
+        return
+    output_dir = APPS_DIR / app / rule_name
+    make_dirs(output_dir)
+    destination = output_dir / registry_key_filename(key)
+    query = subprocess.run(["reg", "query", key], capture_output=True)
+    if query.returncode != 0:
+        debug(f"Not exporting registry key '{key}': key does not exist")
+        return
+    info(f"Exporting registry key '{key}' to '{destination}'")
+    result = subprocess.run(["reg", "export", key, str(destination), "/y"], capture_output=True, text=True)
+    if result.returncode != 0:
+        warn(f"failed to export registry key '{key}': {result.stderr.strip()}")
+        return
+    encrypt_file(destination)
+    finish_ingest(app, rule_name, key)
+
+def import_registry(app: str, rule_name: str, key: str):
+    if sys.platform != "win32":
+        warn(f"not importing registry key '{key}': not running on Windows")
+        return
+    source = APPS_DIR / app / rule_name / registry_key_filename(key)
+    if not source.exists():
+        return
+    print(f"Importing registry key '{key}' from '{source}'")
+    with decrypted_file(source) as plain:
+        result = subprocess.run(["reg", "import", str(plain)], capture_output=True, text=True)
+    if result.returncode != 0:
+        warn(f"failed to import registry key '{key}': {result.stderr.strip()}")
+
+def ingest_plist(app: str, rule_name: str, domain: str):
+    # defaults domains live in cfprefsd, copying the plist file directly may miss unflushed changes
+    if sys.platform != "darwin":
+        debug(f"Not exporting defaults domain '{domain}': not running on macOS")
+        return
+    output_dir = APPS_DIR / app / rule_name
+    make_dirs(output_dir)
+    destination = output_dir / f"{domain}.plist"
+    query = subprocess.run(["defaults", "read", domain], capture_output=True)
+    if query.returncode != 0:
+        debug(f"Not exporting defaults domain '{domain}': domain does not exist")
+        return
+    info(f"Exporting defaults domain '{domain}' to '{destination}'")
+    result = subprocess.run(["defaults", "export", domain, str(destination)], capture_output=True, text=True)
+    if result.returncode != 0:
+        warn(f"failed to export defaults domain '{domain}': {result.stderr.strip()}")
+        return
+    encrypt_file(destination)
+    finish_ingest(app, rule_name, domain)
+
+def import_plist(app: str, rule_name: str, domain: str):
+    if sys.platform != "darwin":
+        warn(f"not importing defaults domain '{domain}': not running on macOS")
+        return
+    source = APPS_DIR / app / rule_name / f"{domain}.plist"
+    if not source.exists():
+        return
+    print(f"Importing defaults domain '{domain}' from '{source}'")
+    with decrypted_file(source) as plain:
+        result = subprocess.run(["defaults", "import", domain, str(plain)], capture_output=True, text=True)
+    if result.returncode != 0:
+        warn(f"failed to import defaults domain '{domain}': {result.stderr.strip()}")
+
+# where browser profiles are stored, relative to a home
+FIREFOX_PROFILE_ROOTS = [
+    ".mozilla/firefox",
+    ".var/app/org.mozilla.firefox/.mozilla/firefox",
+    "AppData/Roaming/Mozilla/Firefox/Profiles",
+    "Library/Application Support/Firefox/Profiles",
+]
+CHROMIUM_PROFILE_ROOTS = [
+    ".config/chromium",
+    ".config/google-chrome",
+    ".config/BraveSoftware/Brave-Browser",
+    "AppData/Local/Chromium/User Data",
+    "AppData/Local/Google/Chrome/User Data",
+    "AppData/Local/BraveSoftware/Brave-Browser/User Data",
+    "Library/Application Support/Google/Chrome",
+]
+
+def find_browser_profiles(homedir: Path):
+    for root in FIREFOX_PROFILE_ROOTS:
+        root = homedir / root
+        if not root.is_dir():
+            continue
+        for profile in root.iterdir():
+            if (profile / "prefs.js").exists():
+                yield "firefox", profile
+    for root in CHROMIUM_PROFILE_ROOTS:
+        root = homedir / root
+        if not root.is_dir():
+            continue
+        for profile in root.iterdir():
+            if (profile / "Preferences").exists():
+                yield "chromium", profile
+
+def browser_origin_storage(browser: str, profile: Path, origin: str):
+    scheme, _, host = origin.rstrip('/').partition('://')
+    host, _, port = host.partition(':')
+    if browser == "firefox":
+        # storage/default has one folder per origin with IndexedDB, localStorage and cache
+        name = f"{scheme}+++{host}" + (f"+{port}" if port else "")
+        yield profile / "storage" / "default" / name
+    elif browser == "chromium":
+        # chromium keeps localStorage of all origins in one leveldb so only IndexedDB is site scoped
+        name = f"{scheme}_{host}_{port or 0}"
+        yield profile / "IndexedDB" / f"{name}.indexeddb.leveldb"
+        yield profile / "IndexedDB" / f"{name}.indexeddb.blob"
+
+def ingest_browser(app: str, rule_name: str, origin: str, homedir: Path):
+    for browser, profile in find_browser_profiles(homedir):
+        for storage in browser_origin_storage(browser, profile, origin):
+            if not storage.exists():
+                continue
+            if is_out_of_time(app):
+                return
+            output_dir = APPS_DIR / app / rule_name / f"{browser}-{profile.name}"
+            make_dirs(output_dir)
+            debug(f"ingest browser storage '{str(storage)}' '{str(output_dir)}'")
+            with timing_app(app):
+                copy_item(storage, output_dir / storage.name)
+            finish_ingest(app, rule_name, str(storage))
+
+def ingest_special(app: str, rule_name: str, kind: str, target: str):
+    if is_out_of_time(app):
+        return
+    if kind == "reg":
+        ingest_registry(app, rule_name, target)
+    elif kind == "plist":
+        ingest_plist(app, rule_name, target)
+
+def git_output(*params):
+    assert git_bin is not None, "git is not installed"
+    result = subprocess.run([git_bin, *params], capture_output=True, stdin=subprocess.DEVNULL)
+    assert result.returncode == 0, f"git {' '.join(params)} failed: {result.stderr.decode(errors='replace').strip()}"
+    return result.stdout
+
+def diff_lines(old_lines, new_lines, old_name: str, new_name: str):
+    from difflib import unified_diff
+    return list(unified_diff(old_lines, new_lines, old_name, new_name, lineterm=""))
+
+def flatten_json(value, prefix="$"):
+    if isinstance(value, dict):
+        for key, item in value.items():
+            yield from flatten_json(item, f"{prefix}.{key}")
+    elif isinstance(value, list):
+        for i, item in enumerate(value):
+            yield from flatten_json(item, f"{prefix}[{i}]")
+    else:
+        yield prefix, value
+
+def diff_json(old: bytes, new: bytes):
+    import json
+    old_values = dict(flatten_json(json.loads(old)))
+    new_values = dict(flatten_json(json.loads(new)))
+    lines = []
+    for key in sorted(old_values.keys() | new_values.keys()):
+        if key not in new_values:
+            lines.append(f"- {key} = {json.dumps(old_values[key])}")
+        elif key not in old_values:
+            lines.append(f"+ {key} = {json.dumps(new_values[key])}")
+        elif old_values[key] != new_values[key]:
+            lines.append(f"~ {key}: {json.dumps(old_values[key])} -> {json.dumps(new_values[key])}")
+    return lines
+
+def sqlite_dump(data: bytes):
+    import sqlite3
+    from tempfile import TemporaryDirectory
+    with TemporaryDirectory() as tmp:
+        db_file = Path(tmp) / "db.sqlite"
+        db_file.write_bytes(data)
+        db = sqlite3.connect(str(db_file))
+        try:
+            return list(db.iterdump())
+        finally:
+            db.close()
+
+def diff_sqlite(old: bytes, new: bytes):
+    return diff_lines(sqlite_dump(old), sqlite_dump(new), "old", "new")
+
+def printable_strings(data: bytes):
+    return [match.decode('ascii') for match in re.findall(rb'[\x20-\x7e]{4,}', data)]
+
+def diff_binary(old: bytes, new: bytes):
+    from hashlib import sha256
+    lines = [
+        f"size: {len(old)} -> {len(new)} ({len(new) - len(old):+d} bytes)",
+        f"sha256: {sha256(old).hexdigest()} -> {sha256(new).hexdigest()}",
+    ]
+    block_size = 4096
+    changed_blocks = [
+        offset
+        for offset in range(0, max(len(old), len(new)), block_size)
+        if old[offset:offset + block_size] != new[offset:offset + block_size]
+    ]
+    lines.append(f"changed {block_size} byte blocks: {len(changed_blocks)}")
+    for offset in changed_blocks[:20]:
+        lines.append(f"  0x{offset:08x}")
+    lines.append("strings:")
+    lines.extend(diff_lines(printable_strings(old), printable_strings(new), "old", "new")[2:])
+    return lines
+
+def diff_file(name: str, old: bytes, new: bytes):
+    if old.startswith(SQLITE_HEADER) and new.startswith(SQLITE_HEADER):
+        return diff_sqlite(old, new)
+    if Path(name).suffix.lower() == ".json":
+        try:
+            return diff_json(old, new)
+        except ValueError:
+            pass
+    if b"\0" not in old[:8192] and b"\0" not in new[:8192]:
+        try:
+            return diff_lines(old.decode('utf-8').splitlines(), new.decode('utf-8').splitlines(), "old", "new")
+        except UnicodeDecodeError:
+            pass
+    return diff_binary(old, new)
+
+def print_rows(rows: list, table):
+    # rows are dicts, table prints them for people
+    import json
+    if args.format == "table":
+        table()
+    elif args.format == "json":
+        print(json.dumps(rows, indent=2))
+    else:
+        for row in rows:
+            try:
+                print(args.format.format_map(row))
+            except KeyError as e:
+                raise AssertionError(f"unknown field {e} in --format, available: {', '.join(row)}")
+
+def history():
+    assert git_bin is not None and (args.output / ".git").exists(), "history needs the output to be a git repo, made with -g"
+    assert args.app in apps, f"unknown app '{args.app}'"
+    path = APPS_DIR.relative_to(args.output) / args.app / (args.rule or "")
+    log = git_output("log", f"-n{args.last}", "--format=%x00%H%x1f%aI%x1f%s", "--name-only", "--", path.as_posix()).decode()
+    rows = []
+    for entry in log.split("\0")[1:]:
+        header, _, files = entry.partition("\n")
+        commit, time, message = header.split("\x1f", 2)
+        host = re.search(r'\bhost=(\S+)', message)
+        rows.append(dict(commit=commit, time=time, host=host.group(1) if host else "unknown", files=len([line for line in files.splitlines() if line != ""]), message=message))
+
+    def table():
+        if len(rows) == 0:
+            print(f"no snapshots of {path.as_posix()}")
+        for row in rows:
+            print(f"{row['commit'][:12]} {row['time']} on {row['host']}: {row['files']} files changed")
+    print_rows(rows, table)
+
+def stats():
+    history = load_run_history()
+    if len(history) == 0 and args.format == "table":
+        print("no runs recorded yet")
+        return
+    rows = [dict(started=run['started'], hostname=run.get('hostname', 'unknown'), status=run.get('status', 'ok'), duration_seconds=run.get('duration_seconds', 0), files=run.get('files_copied', 0), bytes=run.get('bytes_copied', 0), warnings=run.get('warnings', 0)) for run in history[-args.last:]]
+    print_rows(rows, lambda: print_stats(history))
+
+def print_stats(history: list):
+    machines = {}
+    for run in history:
+        machines.setdefault(run.get("hostname", "unknown"), []).append(run)
+    for hostname, runs in sorted(machines.items()):
+        durations = [run["duration_seconds"] for run in runs if "duration_seconds" in run]
+        failed = len([run for run in runs if run.get("status", "ok") != "ok"])
+        print(f"{hostname}: {len(runs)} runs, {failed} failed, last started {runs[-1]['started']}")
+        if len(durations) > 0:
+            print(f"  duration: average {sum(durations) / len(durations):.1f}s, longest {max(durations):.1f}s")
+        print(f"  copied: {sum(run.get('files_copied', 0) for run in runs)} files, {format_size(sum(run.get('bytes_copied', 0) for run in runs))}")
+        print(f"  warnings: {sum(run.get('warnings', 0) for run in runs)}")
+    print("last runs:")
+    for run in history[-args.last:]:
+        print(f"  {run['started']} {run.get('hostname', 'unknown')} {run.get('status', 'ok')} {run.get('duration_seconds', 0):.1f}s {run.get('files_copied', 0)} files {format_size(run.get('bytes_copied', 0))} {run.get('warnings', 0)} warnings")
+
+def sessions():
+    from datetime import datetime
+    all_sessions = load_meta("sessions.json", {})
+    rows = []
+    for machine_id, machine_sessions in sorted(all_sessions.items()):
+        hostname = load_meta("machines.json", {}).get(machine_id, {}).get("hostname", machine_id)
+        for app, app_sessions in sorted(machine_sessions.items()):
+            if len(args.apps) > 0 and app not in args.apps:
+                continue
+            for session in app_sessions:
+                duration = datetime.fromisoformat(session["end"]).timestamp() - datetime.fromisoformat(session["start"]).timestamp()
+                rows.append(dict(app=app, hostname=hostname, start=session["start"], end=session["end"], duration_seconds=duration))
+
+    def table():
+        groups = {}
+        for row in rows:
+            groups.setdefault((row["app"], row["hostname"]), []).append(row)
+        for (app, hostname), app_rows in groups.items():
+            print(f"{app} on {hostname}: {len(app_rows)} sessions, {format_duration(sum(row['duration_seconds'] for row in app_rows))} between the first and last save of each")
+            for row in app_rows[-args.last:]:
+                print(f"  {row['start']} to {row['end']} ({format_duration(row['duration_seconds'])})")
+    print_rows(rows, table)
+
+SPARK_BLOCKS = " ▁▂▃▄▅▆▇█"
+
+def sparkline(values: list):
+    highest = max(values) if len(values) > 0 else 0
+    return "".join(SPARK_BLOCKS[0 if value == 0 else max(1, round(value / highest * (len(SPARK_BLOCKS) - 1)))] for value in values)
+
+def activity():
+    from datetime import datetime, timedelta
+    today = now().replace(hour=0, minute=0, second=0, microsecond=0)
+    first_week = today - timedelta(days=today.weekday(), weeks=args.weeks - 1)
+    def week_of(moment: datetime):
+        index = (moment - first_week).days // 7
+        return index if 0 <= index < args.weeks else None
+    weeks = {}
+    # (sessions, seconds played, snapshots) of each week of each app
+    for machine_sessions in load_meta("sessions.json", {}).values():
+        for app, app_sessions in machine_sessions.items():
+            for session in app_sessions:
+                start = datetime.fromisoformat(session["start"])
+                index = week_of(start)
+                if index is None:
+                    continue
+                week = weeks.setdefault(app, [[0, 0, 0] for _ in range(args.weeks)])[index]
+                week[0] += 1
+                week[1] += datetime.fromisoformat(session["end"]).timestamp() - start.timestamp()
+    selected_apps = args.apps or sorted(weeks)
+    for app in selected_apps:
+        assert app in apps, f"unknown app '{app}'"
+        app_weeks = weeks.setdefault(app, [[0, 0, 0] for _ in range(args.weeks)])
+        if git_bin is not None and (args.output / ".git").exists():
+            # snapshots are the runs that found something new, they should follow the sessions
+            for timestamp in git_output("log", "--format=%at", "--", str(APPS_DIR.relative_to(args.output) / app)).decode().split():
+                index = week_of(datetime.fromtimestamp(int(timestamp)).astimezone())
+                if index is not None:
+                    app_weeks[index][2] += 1
+        played = sum(week[1] for week in app_weeks)
+        print(f"{app} {sparkline([max(week[1], 1) if week[0] > 0 else 0 for week in app_weeks])} {format_duration(played)} in {sum(week[0] for week in app_weeks)} sessions over the last {args.weeks} weeks")
+        for index, (sessions, seconds, snapshots) in enumerate(app_weeks):
+            if sessions + snapshots == 0:
+                continue
+            week_start = (first_week + timedelta(weeks=index)).date().isoformat()
+            print(f"  week of {week_start}: {sessions} sessions, {format_duration(seconds)}, {snapshots} snapshots")
+
+def migrate_export():
+    # secrets like the age identity are left out, they should be moved by hand
+    # exporting the same configuration twice gives the same bytes, so the bundle can be checksummed or kept in a dedup store
+    import json
+    from io import BytesIO
+    files = [dict(role="config", path=str(args.config))]
+    machine_id = get_machine_id()
+    machine_id_file = get_state_dir() / "machine_id"
+    if get_str('general', 'machine_id') is None and machine_id_file.is_file():
+        files.append(dict(role="machine_id", path=str(machine_id_file)))
+    for key in [('general', 'plugins'), ('rules', 'ludusavi_manifest'), ('encryption', 'recipients_file')]:
+        for path in get_paths(*key):
+            if path.is_file():
+                files.append(dict(role="file", path=str(path)))
+    bundle = dict(version=META_VERSION, home=str(Path.home()), hostname=get_hostname(), machine_id=machine_id, output=str(args.output), files=files)
+    with open(args.bundle, 'wb') as raw, deterministic_tar(raw) as tar:
+        data = json.dumps(bundle, indent=2, sort_keys=True).encode()
+        tar.add("migration.json", BytesIO(data), len(data), mode=0o600)
+        for i, item in enumerate(files):
+            with open(item["path"], 'rb') as f:
+                tar.add(f"files/{i}", f, os.fstat(f.fileno()).st_size, mode=0o600)
+            print(f"Bundled '{item['path']}'")
+    print(f"Exported the configuration of {get_hostname()} to '{args.bundle}', import it with: cloud-savegame -c CONFIG -o OUTPUT migrate import '{args.bundle}'")
+
+def migrate_import():
+    import json
+    import tarfile
+    with tarfile.open(args.bundle, 'r:gz') as tar:
+        bundle = json.loads(tar.extractfile("migration.json").read())
+        assert bundle.get("version", 0) <= META_VERSION, "the bundle was made by a newer version of cloud-savegame"
+        old_home = bundle["home"].rstrip('/\\')
+        new_home = str(Path.home())
+        if not args.yes and sys.stdin.isatty():
+            new_home = input(f"The home was '{old_home}' on {bundle['hostname']}, home on this machine [{new_home}]: ").strip() or new_home
+        new_home = new_home.rstrip('/\\')
+        for i, item in enumerate(bundle["files"]):
+            data = tar.extractfile(f"files/{i}").read()
+            if item["role"] == "config":
+                destination = args.config
+            elif item["role"] == "machine_id":
+                # this machine goes on as the old one in the history of the output
+                destination = get_state_dir() / "machine_id"
+            else:
+                destination = Path(replace_folder(item["path"], old_home, new_home) or item["path"])
+            if item["role"] == "config":
+                # the paths of the config point to the old home, the other files like plugins are taken as they are
+                data = replace_folder_in_text(data.decode(), old_home, new_home).encode()
+            if destination.exists() and destination.read_bytes() != data and not confirm(f"'{destination}' exists, overwrite it?"):
+                warn(f"not importing '{destination}': it exists")
+                continue
+            destination.parent.mkdir(exist_ok=True, parents=True)
+            destination.write_bytes(data)
+            print(f"Imported '{item['path']}' to '{destination}'")
+    print(f"This machine now is {bundle['hostname']} ({bundle['machine_id']}) of the output, the paths under '{old_home}' in the configuration were changed to '{new_home}'")
+
+def migrate_legacy():
+    # outputs of the first versions have the apps right in the output and no manifest
+    # everything is changed in place and committed on top, so the git history stays as it was
+    moved = 0
+    if APPS_DIR != args.output:
+        legacy_apps = sorted(item.name for item in args.output.iterdir() if item.is_dir() and item.name in apps)
+        if len(legacy_apps) > 0 and confirm(f"move {', '.join(legacy_apps)} to '{APPS_DIR.relative_to(args.output)}', the folder of layout={get_output_layout()}?"):
+            make_dirs(APPS_DIR)
+            for app in legacy_apps:
+                assert not (APPS_DIR / app).exists(), f"'{APPS_DIR / app}' exists, merge it with '{args.output / app}' by hand first"
+                (args.output / app).rename(APPS_DIR / app)
+                print(f"Moved '{app}' to '{(APPS_DIR / app).relative_to(args.output)}'")
+                moved += 1
+    # files without a manifest entry were copied by a version without one, nobody is known to have written them so
+    # they never count as conflicts and verify can check them from now on
+    hashed = 0
+    for app in sorted(apps):
+        if not (APPS_DIR / app).is_dir():
+            continue
+        for item in sorted((APPS_DIR / app).rglob('*')):
+            manifest_key = item.relative_to(args.output).as_posix()
+            if not item.is_file() or manifest_key in get_manifest():
+                continue
+            get_manifest()[manifest_key] = dict(
+                source_hash=None,
+                hash=hash_file(item),
+                size=item.stat().st_size,
+                mtime=item.stat().st_mtime,
+                machine_id=None,
+                hostname=None,
+                seen={},
+                migrated_from="legacy",
+            )
+            hashed += 1
+    save_manifest()
+    git_commit_if_dirty("migrate legacy output")
+    print(f"{moved} apps moved, {hashed} files added to the manifest")
+    if not args.git and git_is_repo():
+        print("Run it with -g to commit the changes, otherwise the next backup with -g commits them")
+
+def coverage():
+    backed_up = load_meta("coverage.json", {}).get(get_machine_id(), {})
+    machine_misses = load_meta("misses.json", {}).get(get_machine_id(), [])
+    # a miss whose folder exists means the game is there but the rule found nothing in it
+    installed = set(miss["app"] for miss in machine_misses if miss["reason"] != "parent_missing")
+    embedded = sorted(app for app in apps if app not in manifest_rules)
+    covered = [app for app in embedded if app in backed_up]
+    not_covered = [app for app in embedded if app not in backed_up and app in installed]
+    never_found = [app for app in embedded if app not in backed_up and app not in installed]
+    print(f"backed up ({len(covered)}):")
+    for app in covered:
+        print(f"  {app} since {backed_up[app]['first_seen']}, last {backed_up[app]['last_seen']}")
+    print(f"installed but not backed up ({len(not_covered)}):")
+    for app in not_covered:
+        for miss in machine_misses:
+            if miss["app"] == app and miss["reason"] != "parent_missing":
+                print(f"  {app} {miss['rule']}: nothing at '{miss['path']}'")
+    print(f"never found ({len(never_found)}): {', '.join(never_found)}")
+
+def rule_target_exists(kind: str, target: str, variables: dict):
+    if kind == "browser":
+        return any(storage.exists() for browser, profile in find_browser_profiles(Path(variables["home"])) for storage in browser_origin_storage(browser, profile, target))
+    if kind is not None:
+        # registry keys and defaults domains are only known when exported
+        return False
+    path = Path(target)
+    if "*" in path.name:
+        return path.parent.is_dir() and any(path.parent.glob(path.name))
+    return path.exists()
+
+def walk_copy(app: str, input_item: Path, destination: Path, rule_type="files", visited=frozenset()):
+    # yields (source, destination) of the files copy_item would look at, without copying anything
+    if not input_item.exists() or skip_reason(input_item, rule_type) is not None or symlink_skip_reason(input_item, visited) is not None:
+        return
+    if input_item.is_file():
+        yield input_item, destination
+        return
+    items = sorted(item.name for item in input_item.iterdir())
+    if ".git" in items and get_nested_git_policy() == "skip":
+        return
+    stat = input_item.stat()
+    visited = visited | {(stat.st_dev, stat.st_ino)}
+    for item in items:
+        item_destination = destination / item
+        if is_excluded(app, item_destination, is_dir=(input_item / item).is_dir()):
+            continue
+        if item == ".git":
+            if get_nested_git_policy() == "flatten":
+                continue
+            item_destination = destination / NESTED_GIT_RENAMED
+        yield from walk_copy(app, input_item / item, item_destination, rule_type=rule_type, visited=visited)
+
+def rule_status(app: str, rule_name: str, target: str):
+    # counts of files that are up to date, changed since the copy and never copied, their size and the largest ones
+    counts = dict(up_to_date=0, stale=0, missing=0, size=0, largest=[])
+    path = Path(target)
+    if get_bool('general', 'ignore_case') or get_bool(app, 'ignore_case'):
+        path = find_case_insensitive(path) or path
+    output_dir = APPS_DIR / app / rule_name
+    if "*" in path.name:
+        items = [(item, output_dir / item.name if item.is_dir() else output_dir) for item in path.parent.glob(path.name)] if path.parent.is_dir() else []
+    else:
+        items = [(path, output_dir)]
+    rule_type = get_rule_type(app, rule_name)
+    for item, destination in items:
+        if item.is_file():
+            # a file matched by the rule is copied into the rule folder, a folder has its contents copied
+            destination = destination / item.name
+        for source, source_destination in walk_copy(app, item, destination, rule_type=rule_type):
+            manifest_key = source_destination.relative_to(args.output).as_posix()
+            is_sqlite = rule_type == "sqlite" and is_sqlite_file(source)
+            source_hash = None
+            if get_change_detection() != "mtime" and not is_sqlite:
+                source_hash = hash_file(source, source=True)
+            if is_up_to_date(source, source_destination, manifest_key, is_sqlite, source_hash):
+                counts["up_to_date"] += 1
+            elif source_destination.exists():
+                counts["stale"] += 1
+            else:
+                counts["missing"] += 1
+            counts["size"] += source.stat().st_size
+            counts["largest"] = sorted([*counts["largest"], (source.stat().st_size, str(source))], reverse=True)[:getattr(args, 'largest', 0)]
+    return counts
+
+def status_rows(selected_apps: list):
+    # a row for each rule found on this machine and the apps that were not found
+    not_found = set(selected_apps)
+    rows = []
+    for app, rule_name, kind, target, variables, base in resolve_rules():
+        if app not in selected_apps or kind is not None or not rule_target_exists(kind, target, variables):
+            continue
+        set_source_owner(base)
+        counts = rule_status(app, rule_name, target)
+        set_source_owner(None)
+        not_found.discard(app)
+        if counts["stale"] + counts["missing"] == 0:
+            state = "up to date"
+        elif counts["up_to_date"] + counts["stale"] == 0:
+            state = "missing"
+        else:
+            state = "stale"
+        largest = [dict(path=path, bytes=size) for size, path in counts['largest']]
+        rows.append(dict(app=app, rule=rule_name, state=state, files=counts['up_to_date'] + counts['stale'] + counts['missing'], changed=counts['stale'], missing=counts['missing'], bytes=counts['size'], path=target, largest=largest))
+    rows.sort(key=lambda row: row["app"])
+    return rows, not_found
+
+def status():
+    for app in args.apps:
+        assert app in apps, f"unknown app '{app}'"
+    rows, not_found = status_rows(args.apps or sorted(apps))
+    # a rule this big usually matches a whole folder it shouldn't, like all of Documents
+    size_limit = get_size('general', 'suspicious_size') or parse_size(SUSPICIOUS_SIZE)
+
+    def table():
+        for app in sorted(set(row["app"] for row in rows)):
+            print(app)
+            for row in rows:
+                if row["app"] == app:
+                    print(f"  {row['rule']}: {row['state']}, {row['files']} files, {row['changed']} changed, {row['missing']} not backed up, {format_size(row['bytes'])} in '{row['path']}'")
+                    if row['bytes'] > size_limit:
+                        print(f"    bigger than suspicious_size={format_size(size_limit)}, the rule may match more than it should")
+                    for item in row['largest']:
+                        print(f"    {format_size(item['bytes'])} {item['path']}")
+        if len(not_found) > 0:
+            print(f"not found on this machine: {', '.join(sorted(not_found))}")
+    print_rows(rows, table)
+
+# files that are rebuilt by the app and not worth keeping every version of
+DISPOSABLE_SUFFIXES = [".log", ".tmp", ".bak", ".old", ".dmp", ".cache"]
+# a rule with this many files is cheaper in git as one archive
+ARCHIVE_SUGGESTED_FILES = 500
+
+def analyze():
+    from collections import Counter
+    for app in args.apps:
+        assert app in apps, f"unknown app '{app}'"
+    selected_apps = set(args.apps or apps)
+    size_limit = get_size('general', 'suspicious_size') or parse_size(SUSPICIOUS_SIZE)
+    prefix = APPS_DIR.relative_to(args.output).parts
+    def rule_of(path: str):
+        parts = Path(path).parts
+        if parts[:len(prefix)] != prefix or len(parts) < len(prefix) + 3 or parts[len(prefix)] not in selected_apps:
+            return None
+        return parts[len(prefix)], parts[len(prefix) + 1]
+    rules = {}
+    for app in sorted(selected_apps):
+        if not (APPS_DIR / app).is_dir():
+            continue
+        for rule_dir in sorted((APPS_DIR / app).iterdir()):
+            if rule_dir.is_dir():
+                files = [item for item in rule_dir.rglob("*") if item.is_file()]
+                rules[(app, rule_dir.name)] = dict(app=app, rule=rule_dir.name, files=len(files), bytes=sum(item.stat().st_size for item in files), history_bytes=0, changes=0, suffixes=Counter())
+                for item in files:
+                    rules[(app, rule_dir.name)]["suffixes"][item.suffix.lower()] += item.stat().st_size
+    # every version of every file ever committed, with the commits that changed each path
+    blobs = []
+    churn = Counter()
+    history_bytes = Counter()
+    loose_bytes = 0
+    if git_bin is not None and (args.output / ".git").exists():
+        objects = git_output("rev-list", "--objects", "--all", "--", *prefix).decode().splitlines()
+        result = subprocess.run([git_bin, "cat-file", "--batch-check=%(objecttype) %(objectsize) %(rest)"], input="\n".join(objects).encode(), capture_output=True)
+        assert result.returncode == 0, f"git cat-file failed: {result.stderr.decode(errors='replace').strip()}"
+        for line in result.stdout.decode().splitlines():
+            kind, size, path = (line.split(" ", 2) + [""])[:3]
+            if kind == "blob" and rule_of(path) is not None:
+                blobs.append((int(size), path))
+                history_bytes[path] += int(size)
+        for path in git_output("log", "--format=", "--name-only", "--", *prefix).decode().splitlines():
+            if path != "" and rule_of(path) is not None:
+                churn[path] += 1
+        loose_bytes = int(dict(line.split(": ") for line in git_output("count-objects", "-v").decode().splitlines()).get("size", 0)) * 1024
+    for path, size in history_bytes.items():
+        rule = rules.get(rule_of(path))
+        if rule is not None:
+            rule["history_bytes"] += size
+            rule["changes"] += churn[path]
+    suggestions = []
+    def suggest(app, key, value, reason):
+        suggestions.append(dict(app=app, key=key, value=value, reason=reason))
+    for (app, rule_name), rule in rules.items():
+        if rule["files"] >= ARCHIVE_SUGGESTED_FILES and not is_archived(app, rule_name):
+            suggest(app, f"archive_{rule_name}", "true", f"{rule['files']} files, one archive is a single object in git instead of one for each")
+        excluded = get_list(app, f"exclude_{rule_name}") or []
+        for suffix, size in rule["suffixes"].most_common():
+            if suffix in DISPOSABLE_SUFFIXES and f"*{suffix}" not in excluded:
+                suggest(app, f"exclude_{rule_name}", f"*{suffix}", f"{format_size(size)} of {suffix} files the app can do without")
+        if rule["bytes"] > size_limit:
+            suffix, size = rule["suffixes"].most_common(1)[0]
+            suggest(app, f"exclude_{rule_name}", f"*{suffix}" if suffix != "" else "PATTERN", f"{format_size(rule['bytes'])}, bigger than suspicious_size={format_size(size_limit)}, {format_size(size)} of it are {suffix or 'files without extension'}, check the rule doesn't match more than it should")
+    for path, changes in churn.most_common():
+        app, rule_name = rule_of(path)
+        if history_bytes[path] > size_limit and not any(suggestion["key"] == f"exclude_{rule_name}" and suggestion["app"] == app for suggestion in suggestions):
+            suggest(app, f"exclude_{rule_name}", Path(path).name, f"'{path}' changed in {changes} snapshots and its versions take {format_size(history_bytes[path])}, exclude it if the app rebuilds it")
+    if loose_bytes > size_limit:
+        suggest(None, "git gc", "", f"{format_size(loose_bytes)} of snapshots are loose objects, packing them stores the versions of a file as deltas of each other")
+
+    def table():
+        print("largest rules:")
+        for rule in sorted(rules.values(), key=lambda rule: rule["history_bytes"] + rule["bytes"], reverse=True)[:args.top]:
+            print(f"  {rule['app']}/{rule['rule']}: {format_size(rule['bytes'])} in {rule['files']} files, {format_size(rule['history_bytes'])} over {rule['changes']} changes in the history")
+        if len(blobs) > 0:
+            print("largest versions in the history:")
+            for size, path in sorted(blobs, reverse=True)[:args.top]:
+                print(f"  {format_size(size)} {path}")
+            print("most changed files:")
+            for path, changes in churn.most_common(args.top):
+                print(f"  {changes} snapshots, {format_size(history_bytes[path])} {path}")
+        if len(suggestions) == 0:
+            print("nothing to suggest")
+            return
+        print("suggestions:")
+        for suggestion in suggestions:
+            if suggestion["app"] is None:
+                print(f"  run {suggestion['key']} in '{args.output}': {suggestion['reason']}")
+            else:
+                print(f"  [{suggestion['app']}] {suggestion['key']}={suggestion['value']}: {suggestion['reason']}")
+    print_rows(suggestions, table)
+
+def verify():
+    # a copy cut short has another size, a flipped bit has the same size and another hash
+    for app in args.apps:
+        assert app in apps, f"unknown app '{app}'"
+    prefix = APPS_DIR.relative_to(args.output).parts
+    def selected(key: str):
+        parts = Path(key).parts
+        return parts[:len(prefix)] == prefix and len(parts) > len(prefix) and (len(args.apps) == 0 or parts[len(prefix)] in args.apps)
+    rows = []
+    checked = 0
+    for key, entry in sorted(get_manifest().items()):
+        if not selected(key) or "hash" not in entry:
+            continue
+        checked += 1
+        path = args.output / key
+        if not path.is_file():
+            rows.append(dict(path=key, problem="missing", expected=entry["hash"], actual=None))
+            continue
+        size = path.stat().st_size
+        if entry.get("size") is not None and size != entry["size"]:
+            rows.append(dict(path=key, problem="partial" if size < entry["size"] else "size", expected=entry["size"], actual=size))
+            continue
+        actual = hash_file(path, algorithm=entry["hash"].split(":")[0])
+        if actual != entry["hash"]:
+            rows.append(dict(path=key, problem="corrupted", expected=entry["hash"], actual=actual))
+    # files copied by older versions or put there by hand can't be checked
+    unchecked = [item for item in sorted(APPS_DIR.rglob('*')) if item.is_file() and item.relative_to(args.output).as_posix() not in get_manifest() and selected(item.relative_to(args.output).as_posix()) and item.parts[len(APPS_DIR.parts)] in apps] if APPS_DIR.is_dir() else []
+
+    def table():
+        descriptions = dict(missing="is in the manifest but not in the output", partial="is smaller than when it was copied, the copy was probably cut short", size="has another size than when it was copied", corrupted="has the same size but another content than when it was copied")
+        for row in rows:
+            print(f"{row['path']} {descriptions[row['problem']]}")
+        for item in unchecked:
+            debug(f"{item.relative_to(args.output).as_posix()} is not in the manifest, it can't be checked")
+        print(f"{checked} files checked, {len(rows)} with problems, {len(unchecked)} not in the manifest")
+    print_rows(rows, table)
+    if len(rows) > 0:
+        sys.exit(1)
+
+def tui(selected=(), action=None):
+    import curses
+    curses.wrapper(tui_main, set(selected), action)
+
+def tui_apps():
+    # (app, state, last backup) of each app found on this machine
+    global manifest
+    manifest = None
+    rows, not_found = status_rows(sorted(apps))
+    backed_up = load_meta("coverage.json", {}).get(get_machine_id(), {})
+    entries = []
+    for app in sorted(set(row["app"] for row in rows)):
+        states = set(row["state"] for row in rows if row["app"] == app)
+        state = "up to date" if states == {"up to date"} else "missing" if states == {"missing"} else "stale"
+        entries.append((app, state, backed_up.get(app, {}).get("last_seen", "never")))
+    return entries
+
+def tui_run(command: list, log: list, redraw):
+    # the backup or restore runs as another process, its output is shown as it comes
+    global_args = sys.argv[1:sys.argv.index(args.command)]
+    # one run, like the ones of --interval and watch, with interval in [cli] it would loop and the TUI would wait forever
+    environment = dict(os.environ, PYTHONUNBUFFERED="1", CLOUD_SAVEGAME_SCHEDULED="1")
+    process = subprocess.Popen([sys.executable, str(Path(__file__).resolve()), *global_args, *command], cwd=launch_dir, stdout=subprocess.PIPE, stderr=subprocess.STDOUT, stdin=subprocess.DEVNULL, text=True, env=environment)
+    for line in process.stdout:
+        log.append(line.rstrip())
+        redraw()
+    process.wait()
+    log.append(f"finished with exit code {process.returncode}")
+
+# keys of each action of the TUI, the controller ones are what Steam Input maps the buttons to in its keyboard layouts
+TUI_KEYS = dict(
+    select=[ord(' ')],
+    all=[ord('a')],
+    backup=[ord('b')],
+    restore=[ord('r')],
+    quit=[ord('q'), 27],
+)
+TUI_CONTROLLER_KEYS = dict(
+    select=[ord(' '), ord('\n'), ord('\r')],
+    all=[ord('a')],
+    backup=[ord('x'), ord('b')],
+    restore=[ord('y'), ord('r')],
+    quit=[ord('q'), 27],
+)
+
+def tui_draw(screen, entries: list, selected: set, cursor: int, log: list, message: str):
+    import curses
+    screen.erase()
+    height, width = screen.getmaxyx()
+    if args.controller:
+        keys_help = "A select  X back up  Y restore  B quit"
+    else:
+        keys_help = "space select  a all  b back up  r restore  q quit"
+    screen.addnstr(0, 0, keys_help, width - 1, curses.A_BOLD)
+    list_height = max(1, (height - 3) // 2)
+    top = max(0, cursor - list_height + 1)
+    for i, (app, state, last) in enumerate(entries[top:top + list_height]):
+        index = top + i
+        line = f"[{'x' if app in selected else ' '}] {app:40} {state:10} last backup {last}"
+        screen.addnstr(1 + i, 0, line, width - 1, curses.A_REVERSE if index == cursor else curses.A_NORMAL)
+    screen.addnstr(2 + list_height, 0, message, width - 1, curses.A_BOLD)
+    log_height = height - list_height - 3
+    for i, line in enumerate(log[-log_height:] if log_height > 0 else []):
+        screen.addnstr(3 + list_height + i, 0, line, width - 1)
+    screen.refresh()
+
+def tui_main(screen, selected: set, action):
+    import curses
+    curses.curs_set(0)
+    if hasattr(curses, "set_escdelay"):
+        # B is Escape with a controller, waiting the default second for an escape sequence makes it feel broken
+        curses.set_escdelay(50)
+    keys = TUI_CONTROLLER_KEYS if args.controller else TUI_KEYS
+    entries = tui_apps()
+    cursor = 0
+    log = []
+    message = f"{len(entries)} apps found on this machine"
+    while True:
+        if action is None:
+            tui_draw(screen, entries, selected, cursor, log, message)
+            key = screen.getch()
+            action = next((name for name, codes in keys.items() if key in codes), None)
+        else:
+            # given by a link, like cloud-savegame://restore/app
+            key = None
+        if action == "quit":
+            return
+        if key in (curses.KEY_DOWN, ord('j')) and cursor + 1 < len(entries):
+            cursor += 1
+        elif key in (curses.KEY_UP, ord('k')) and cursor > 0:
+            cursor -= 1
+        elif action == "select" and len(entries) > 0:
+            selected ^= {entries[cursor][0]}
+        elif action == "all":
+            selected = set() if len(selected) == len(entries) else set(app for app, state, last in entries)
+        elif action in ("backup", "restore"):
+            if len(selected) == 0:
+                message = "select some apps first"
+                action = None
+                continue
+            redraw = lambda: tui_draw(screen, entries, selected, cursor, log, "running...")
+            if action == "backup":
+                tui_run(["--only-apps", ",".join(sorted(selected))], log, redraw)
+            else:
+                confirm = "A to confirm, B to cancel" if args.controller else "y/n"
+                message = f"restore {', '.join(sorted(selected))}, overwriting local files that are newer? {confirm}"
+                tui_draw(screen, entries, selected, cursor, log, message)
+                if screen.getch() not in ([ord('y'), ord('\n'), ord('\r')] if args.controller else [ord('y')]):
+                    message = "nothing restored"
+                    action = None
+                    continue
+                tui_run(["restore", *sorted(selected), "-y"], log, redraw)
+            entries = tui_apps()
+            cursor = min(cursor, max(0, len(entries) - 1))
+            message = f"{len(entries)} apps found on this machine"
+        action = None
+
+URL_SCHEME = "cloud-savegame"
+URL_ACTIONS = ["status", "backup", "restore"]
+
+def url_command():
+    # what a cloud-savegame:// link runs, with the configuration and output of the url register that created it
+    return [sys.executable, str(Path(__file__).resolve()), "-c", str(args.config), "-o", str(args.output), "url", "open"]
+
+def url_register():
+    if sys.platform == "win32":
+        import winreg
+        with winreg.CreateKey(winreg.HKEY_CURRENT_USER, f"Software\\Classes\\{URL_SCHEME}") as key:
+            winreg.SetValueEx(key, None, 0, winreg.REG_SZ, f"URL:{URL_SCHEME}")
+            winreg.SetValueEx(key, "URL Protocol", 0, winreg.REG_SZ, "")
+        with winreg.CreateKey(winreg.HKEY_CURRENT_USER, f"Software\\Classes\\{URL_SCHEME}\\shell\\open\\command") as key:
+            winreg.SetValueEx(key, None, 0, winreg.REG_SZ, subprocess.list2cmdline(url_command()) + ' "%1"')
+        print(f"Registered {URL_SCHEME}:// links for this user")
+        return
+    assert sys.platform != "darwin", "macOS only opens links with app bundles, run url open in a terminal instead"
+    # quoting of Exec in desktop entries: arguments in double quotes, escaping the characters the spec reserves
+    quote = lambda arg: '"' + re.sub(r'(["`$\\])', r'\\\1', arg) + '"'
+    applications = Path(os.environ.get("XDG_DATA_HOME") or Path.home() / ".local/share") / "applications"
+    applications.mkdir(parents=True, exist_ok=True)
+    desktop_file = applications / f"{URL_SCHEME}-url.desktop"
+    desktop_file.write_text("\n".join([
+        "[Desktop Entry]",
+        "Type=Application",
+        "Name=cloud-savegame",
+        f"Exec={' '.join(quote(arg) for arg in url_command())} %u",
+        "Terminal=true",
+        "NoDisplay=true",
+        f"MimeType=x-scheme-handler/{URL_SCHEME};",
+        "",
+    ]))
+    if which("xdg-mime") is None:
+        warn(f"xdg-mime not found, make {desktop_file.name} the default for x-scheme-handler/{URL_SCHEME} by hand")
+    else:
+        subprocess.run(["xdg-mime", "default", desktop_file.name, f"x-scheme-handler/{URL_SCHEME}"], check=True)
+    if which("update-desktop-database") is not None:
+        subprocess.run(["update-desktop-database", str(applications)], stderr=subprocess.DEVNULL)
+    print(f"Registered {URL_SCHEME}:// links for this user in '{desktop_file}'")
+    print(f"For Game Mode, add a non-Steam game with this as the target and pick a keyboard layout in Steam Input: {' '.join(url_command())} {URL_SCHEME}://status")
+
+def url_open():
+    # cloud-savegame://<action>/<app>/<app>..., the apps come selected and backup and restore start right away
+    from urllib.parse import urlsplit, unquote
+    url = urlsplit(args.url)
+    assert url.scheme == URL_SCHEME, f"not a {URL_SCHEME}:// link: '{args.url}'"
+    assert url.netloc in URL_ACTIONS, f"unknown action '{url.netloc}', use {', '.join(URL_ACTIONS)}"
+    selected = [unquote(part) for part in url.path.split("/") if part != ""]
+    for app in selected:
+        assert app in apps, f"unknown app '{app}'"
+    args.controller = True
+    tui(selected, None if url.netloc == "status" else url.netloc)
+
+JSON_SCHEMA = "https://json-schema.org/draft/2020-12/schema"
+# variables rules can start with, resolved for each place found
+RULE_VARIABLES = ["home", "appdata", "documents", "xdg_config", "xdg_data", "xdg_state", "library", "application_support", "installdir", "winedrive_c", "steam", "steamapps", "steamuserdata", "gog_cloud"]
+# sections where the keys are names chosen by the user, like the OS users of [household]
+FREE_FORM_SECTIONS = {"household": "Profile of each OS user, home folder name or Steam account id"}
+
+def rules_schema():
+    # a line of a rules file split in its parts, the options are the ones of RULE_OPTIONS
+    flag = dict(type="string", enum=["true", "1", "yes", "false", "0", "no"])
+    listing = lambda items: dict(type="string", pattern=f"^({'|'.join(map(re.escape, items))})(,({'|'.join(map(re.escape, items))}))*$")
+    return {
+        "$schema": JSON_SCHEMA,
+        "title": "cloud-savegame rule",
+        "description": "A line of a file in the rules folder: the name, the path and the options, like saves $home/.game/saves archive=true",
+        "type": "object",
+        "required": ["name", "path"],
+        "properties": {
+            "name": dict(type="string", pattern=r"^\S+$", description="Folder of the rule in the output"),
+            "path": dict(type="string", description=f"Path starting with a variable, {', '.join('$' + variable for variable in RULE_VARIABLES)}, a relative path or one of {', '.join(SPECIAL_RULE_KINDS + list(SPECIAL_RULE_ALIASES))} followed by what it points to", anyOf=[
+                dict(pattern=f"^\\$({'|'.join(RULE_VARIABLES)})(/.*)?$"),
+                dict(pattern=f"^({'|'.join(SPECIAL_RULE_KINDS + list(SPECIAL_RULE_ALIASES))}) .+$"),
+                dict(pattern=r"^[^$/\\].*$"),
+            ]),
+            "options": {
+                "type": "object",
+                "additionalProperties": False,
+                "properties": dict(
+                    archive=dict(flag, description="Pack the folders of the rule in one deterministic _archive.tar.gz"),
+                    exclude=dict(type="string", description="Patterns of files not copied, separated by commas"),
+                    type=dict(type="string", enum=["files", "sqlite"], description="sqlite copies databases with the sqlite backup API"),
+                    format=dict(listing(SAVE_FORMATS), description="Formats of the files, checked and described in the manifest"),
+                    slots=dict(type="string", pattern=r"^.*\{n\}.*:[0-9]+$", description="Save slots, like save{n}.dat:10"),
+                    free_slots=dict(flag, description="Restore to free slots instead of overwriting different local saves"),
+                    transform=dict(listing(TRANSFORMS), description="Transforms of text files when they are copied"),
+                    validate=dict(type="string", description=f"Checks of the copies before they replace the previous version, {', '.join(list(VALIDATORS) + list(SAVE_FORMATS))} or a command"),
+                    platform=dict(type="string", enum=list(RULE_PLATFORMS), description="Only use the rule on this platform"),
+                ),
+            },
+        },
+    }
+
+def config_schema():
+    # made from the documented keys of demo.cfg, the comments above each key are its description, keys right below each other share it
+    # keys ending with the name of an app or a rule of the example apps, like format_saves or pre_app_minecraft, are patterns
+    sections = {}
+    app_keys = {}
+    section = None
+    description = []
+    current = ""
+    for line in DEFAULT_CONFIG_FILE.read_text().splitlines():
+        line = line.strip()
+        section_match = re.fullmatch(r'\[(.+)\]', line)
+        key_match = re.fullmatch(r'#?\s?([a-z0-9_]+)=(.*)', line)
+        if section_match is not None:
+            section = section_match.group(1)
+            description = []
+            current = ""
+        elif key_match is not None and section is not None:
+            key, example = key_match.groups()
+            if len(description) > 0:
+                current = " ".join(description)
+                description = []
+            is_app = section in apps
+            names = [rule_name for rule_name, rule_path in parse_rules(section)] if is_app else sorted(apps)
+            suffix = next((name for name in sorted(names, key=len, reverse=True) if key.endswith(f"_{name}")), None)
+            keys = app_keys if is_app else sections.setdefault(section, {})
+            if suffix is not None:
+                key = f"^{re.escape(key[:-len(suffix)])}.+$"
+            entry = keys.setdefault(key, dict(type="string", description=current, examples=[]))
+            if example not in entry["examples"]:
+                entry["examples"].append(example)
+            if not entry["description"]:
+                entry["description"] = current
+        elif line.startswith("#"):
+            description.append(line.lstrip("# "))
+        else:
+            description = []
+            current = ""
+    def section_schema(name, keys):
+        if name in FREE_FORM_SECTIONS:
+            return dict(type="object", description=FREE_FORM_SECTIONS[name], additionalProperties=dict(type="string"))
+        return dict(
+            type="object",
+            properties={key: value for key, value in keys.items() if not key.startswith("^")},
+            patternProperties={key: value for key, value in keys.items() if key.startswith("^")},
+            # app sections also take some keys of [general], like ignore_case and max_file_size
+            additionalProperties=dict(type="string") if name is None else False,
+        )
+    return {
+        "$schema": JSON_SCHEMA,
+        "title": "cloud-savegame configuration",
+        "description": "Sections of the ini configuration, sections named after an app configure that app",
+        "type": "object",
+        "properties": {name: section_schema(name, keys) for name, keys in sections.items()},
+        "additionalProperties": section_schema(None, app_keys),
+    }
+
+def report_schema():
+    # each line of __meta__/runs.jsonl, written by record_run_history
+    count = dict(type="integer", minimum=0)
+    return {
+        "$schema": JSON_SCHEMA,
+        "title": "cloud-savegame run",
+        "description": "A run of a backup, one per line of __meta__/runs.jsonl",
+        "type": "object",
+        "required": ["version", "started"],
+        "properties": dict(
+            version=dict(type="integer", maximum=META_VERSION, description="Format of the meta files"),
+            machine_id=dict(type="string", description="Machine that ran it, stays the same after renames"),
+            hostname=dict(type="string"),
+            started=dict(type="string", format="date-time"),
+            duration_seconds=dict(type="number", minimum=0),
+            bytes_copied=count,
+            files_copied=count,
+            files_checked=count,
+            files_unreadable=dict(count, description="Files that couldn't be read, even after retrying on network shares"),
+            files_invalid=dict(count, description="Copies that failed validate_<rule>"),
+            warnings=count,
+            apps=dict(count, description="Apps that had rules copied"),
+            status=dict(type="string", enum=["ok", "timeout", "failed", "interrupted"], description="timeout when --timeout or time_budget left apps out"),
+        ),
+    }
+
+def schema():
+    import json
+    schemas = dict(rules=rules_schema, config=config_schema, report=report_schema)
+    print(json.dumps(schemas[args.what](), indent=2))
+
+def split_config_key(key: str):
+    # app sections can have dots in their names, keys can't
+    section, _, name = key.rpartition(".")
+    assert section != "" and name != "", f"'{key}' is not section.key, like search.paths"
+    return section, name.lower()
+
+def config_get():
+    section, name = split_config_key(args.key)
+    value = get_str(section, name)
+    if value is None:
+        sys.exit(1)
+    print(value)
+
+def config_edit(action: str, key: str, value=None):
+    # configparser would drop the comments when writing, so the lines of the key are changed in place
+    section, name = split_config_key(key)
+    lines = args.config.read_text().splitlines()
+    current = None
+    # new keys go after the last key of the section, or right after its header
+    section_end = None
+    key_line = None
+    for i, line in enumerate(lines):
+        header = re.fullmatch(r'\s*\[(.+)\]\s*', line)
+        if header is not None:
+            current = header.group(1)
+            if current == section:
+                section_end = i + 1
+            continue
+        if current != section or line.strip() == "" or line.lstrip().startswith(("#", ";")):
+            continue
+        section_end = i + 1
+        match = re.match(r'\s*([^=:]+?)\s*[=:]', line)
+        if match is not None and match.group(1).lower() == name:
+            key_line = i
+    if action == "unset":
+        if key_line is None:
+            print(f"{section}.{name} is not set")
+            return
+        del lines[key_line]
+    elif key_line is not None:
+        lines[key_line] = f"{name}={value}"
+    elif section_end is not None:
+        lines.insert(section_end, f"{name}={value}")
+    else:
+        lines += ["", f"[{section}]", f"{name}={value}"]
+    text = "\n".join(lines) + "\n"
+    # a change that doesn't parse never reaches the file
+    check = ConfigParser()
+    check.read_string(text)
+    partial = args.config.with_name(args.config.name + ".tmp")
+    partial.write_text(text)
+    os.replace(partial, args.config)
+    print(f"{'Removed' if action == 'unset' else 'Set'} {section}.{name} in '{args.config}'")
+
+def list_apps():
+    for app in args.apps:
+        assert app in apps, f"unknown app '{app}'"
+    selected_apps = args.apps or sorted(apps)
+    detected = set(app for app, rule_name, kind, target, variables, base in resolve_rules() if app in selected_apps and rule_target_exists(kind, target, variables))
+    rows = []
+    for app in selected_apps:
+        source = "ludusavi manifest" if app in manifest_rules else "rules"
+        for rule_name, rule_path in parse_rules(app):
+            kind, target = parse_rule_kind(rule_path)
+            variables = re.findall(r'\$([a-z_]+)', rule_path)
+            uses = kind if kind is not None else ", ".join(f"${var}" for var in variables) or "absolute path"
+            rows.append(dict(app=app, found=app in detected, source=source, rule=rule_name, path=rule_path, uses=uses))
+
+    def table():
+        for app in selected_apps:
+            source = "ludusavi manifest" if app in manifest_rules else "rules"
+            print(f"{app} ({'found' if app in detected else 'not found'} on this machine, from {source})")
+            for row in rows:
+                if row["app"] == app:
+                    print(f"  {row['rule']}: {row['path']} ({row['uses']})")
+    print_rows(rows, table)
+
+def show_diff():
+    file = (args.output / args.file).resolve()
+    assert str(file).startswith(str(args.output)), f"'{args.file}' is not inside the output folder"
+    relative = file.relative_to(args.output)
+    revisions = git_output("log", "--format=%H", "-n", "2", "--", str(relative)).decode().split()
+    to_rev = args.to_rev or (revisions[0] if len(revisions) > 0 else None)
+    from_rev = args.from_rev or (revisions[1] if len(revisions) > 1 else None)
+    assert to_rev is not None and from_rev is not None, f"'{relative}' doesn't have two snapshots to compare"
+    old = decrypt_bytes(git_output("show", f"{from_rev}:{relative.as_posix()}"))
+    new = decrypt_bytes(git_output("show", f"{to_rev}:{relative.as_posix()}"))
+    print(f"--- {relative} @ {from_rev[:12]}")
+    print(f"+++ {relative} @ {to_rev[:12]}")
+    lines = diff_file(relative.name, old, new)
+    if len(lines) == 0:
+        print("no changes")
+    for line in lines:
+        print(line)
+
+CONTAINER_DEFAULT_SOURCES = ["/sources"]
+
+def get_container_homes():
+    # each source is a mount of a home or of a folder with homes, the container itself has no meaningful home
+    sources = get_paths('container', 'sources') or [Path(p) for p in CONTAINER_DEFAULT_SOURCES]
+    for source in sources:
+        if not source.is_dir():
+            warn(f"container source '{str(source)}' is not mounted")
+            continue
+        if any((source / sentinel).exists() for sentinel in ["AppData", "Documents", "Documentos", ".config", ".local", "Library"]):
+            yield source
+            continue
+        for appdata in source.glob('**/AppData'):
+            yield appdata.parents[0]
+        for config_dir in source.glob('*/.config'):
+            yield config_dir.parents[0]
+        for application_support in source.glob('*/Library/Application Support'):
+            yield application_support.parents[1]
+
+# where homes usually are on each platform, as preset: (paths, extra_homes)
+SEARCH_PRESETS = {
+    "windows-default": (["C:/Users"], []),
+    "linux-xdg": (["~"], ["~"]),
+    # the Proton prefixes of the deck, also in SD cards, are found from the Steam libraries
+    "steamdeck": (["~"], ["~"]),
+    "macos": (["/Users"], []),
+    "wsl": (["/mnt/c/Users"], ["~"]),
+}
+
+def detect_search_preset():
+    if sys.platform == "win32":
+        return "windows-default"
+    if sys.platform == "darwin":
+        return "macos"
+    proc_version = Path("/proc/version")
+    if proc_version.is_file() and "microsoft" in proc_version.read_text().lower():
+        return "wsl"
+    os_release = Path("/etc/os-release")
+    if os_release.is_file() and re.search(r'^ID="?steamos"?$', os_release.read_text(), re.MULTILINE):
+        return "steamdeck"
+    return "linux-xdg"
+
+def get_search_presets():
+    # without any place to search in the config the preset of this platform is used
+    if hasattr(get_search_presets, "cached"):
+        return get_search_presets.cached
+    presets = get_list('search', 'preset')
+    if presets is None:
+        configured = len(get_paths('search', 'paths')) > 0 or len(get_paths('search', 'extra_homes')) > 0
+        presets = [] if configured else ["auto"]
+    presets = [detect_search_preset() if preset == "auto" else preset for preset in presets]
+    for preset in presets:
+        assert preset in SEARCH_PRESETS, f"unknown search preset '{preset}', available: auto, {', '.join(SEARCH_PRESETS)}"
+    if len(presets) > 0:
+        debug(f"Using the search presets {', '.join(presets)}")
+    get_search_presets.cached = presets
+    return presets
+
+def get_search_paths(key: str):
+    # paths or extra_homes of [search] with the ones of the presets
+    index = 0 if key == "paths" else 1
+    preset_paths = [Path(os.path.expanduser(p)) for preset in get_search_presets() for p in SEARCH_PRESETS[preset][index]]
+    return get_paths('search', key) + [path.resolve() for path in preset_paths if path.is_dir()]
+
+def find_base_homes():
+    if args.container:
+        yield from get_container_homes()
+        return
+    for home in get_search_paths('extra_homes'):
+        if not home.exists():
+            warn(f"extra home '{str(home)}' does not exist")
+        else:
+            yield home
+    for search_path in get_search_paths('paths'):
+        for appdata in search_path.glob('**/AppData'):
+            yield appdata.parents[0]
+        # macOS homes have no AppData
+        for application_support in search_path.glob('**/Library/Application Support'):
+            yield application_support.parents[1]
+
+def dedup_paths(paths):
+    seen = set()
+    for path in paths:
+        resolved = path.resolve()
+        if resolved in seen:
+            continue
+        seen.add(resolved)
+        yield path
+
+def get_base_homes():
+    if not hasattr(get_base_homes, "cached"):
+        get_base_homes.cached = list(dedup_paths(find_base_homes()))
+    return get_base_homes.cached
+
+# where wine prefixes are usually created, relative to a home
+WINE_PREFIX_GLOBS = [".wine", ".local/share/wineprefixes/*", "Games/*", ".local/share/lutris/prefixes/*", ".PlayOnLinux/wineprefix/*"]
+
+def find_wine_prefixes():
+    roots = [Path.home(), *get_search_paths('paths'), *get_base_homes()]
+    for root in dedup_paths(root for root in roots if root.is_dir()):
+        for pattern in WINE_PREFIX_GLOBS:
+            for prefix in root.glob(pattern):
+                if (prefix / "drive_c").is_dir():
+                    yield prefix
+    # Proton makes one prefix per game in each Steam library
+    for steam_root in get_steam_roots():
+        for library in get_steam_libraries(steam_root):
+            for prefix in (library / "compatdata").glob('*/pfx'):
+                if (prefix / "drive_c").is_dir():
+                    yield prefix
+    for prefix in get_paths('search', 'wine_prefixes'):
+        if not (prefix / "drive_c").is_dir():
+            warn(f"wine prefix '{str(prefix)}' doesn't have a drive_c")
+            continue
+        yield prefix
+
+def get_wine_prefixes():
+    if not hasattr(get_wine_prefixes, "cached"):
+        get_wine_prefixes.cached = list(dedup_paths(find_wine_prefixes()))
+    return get_wine_prefixes.cached
+
+def get_homes():
+    # the homes found by the search and the users of each wine prefix
+    if not hasattr(get_homes, "cached"):
+        homes = list(get_base_homes())
+        for prefix in get_wine_prefixes():
+            users = prefix / "drive_c" / "users"
+            if users.is_dir():
+                homes.extend(user for user in users.iterdir() if user.is_dir() and user.name.lower() != "public" and not user.is_symlink())
+        homes = list(dedup_paths(homes))
+        if get_output_layout() == "per_user":
+            # the saves of other people in homes found by the search go to their own profile when they run it
+            for homedir in [homedir for homedir in homes if get_home_profile(homedir) != get_profile()]:
+                debug(f"Skipping '{homedir}': it is of the profile {get_home_profile(homedir)}")
+                homes.remove(homedir)
+        get_homes.cached = homes
+    return get_homes.cached
+
+# XDG base directories, as variable: (environment variable, default relative to the home)
+XDG_VARIABLES = {
+    "xdg_config": ("XDG_CONFIG_HOME", ".config"),
+    "xdg_data": ("XDG_DATA_HOME", ".local/share"),
+    "xdg_state": ("XDG_STATE_HOME", ".local/state"),
+}
+
+def get_xdg_dir(homedir: Path, var: str):
+    # the environment only says something about the home of the user running this, other homes get the default
+    env_var, default = XDG_VARIABLES[var]
+    value = os.environ.get(env_var)
+    if value and Path(value).is_absolute() and homedir.resolve() == Path.home().resolve():
+        return Path(value).resolve()
+    return (homedir / default).resolve()
+
+def substitute_variable(rule_path: str, var: str, value: str):
+    # $steam is not the start of $steamapps, a variable ends where the name does
+    return re.sub(rf'\${var}(?![a-z_])', lambda match: value, rule_path)
+
+def resolve_wine_rules():
+    for prefix in get_wine_prefixes():
+        drive_c = prefix / "drive_c"
+        for game in sorted(var_users.get('winedrive_c') or []):
+            for rule_name, rule_path in parse_rules(game):
+                resolved_rule_path = substitute_variable(rule_path, 'winedrive_c', str(drive_c.resolve()))
+                if rule_path == resolved_rule_path:
+                    continue
+                yield game, rule_name, None, resolved_rule_path, dict(winedrive_c=str(drive_c.resolve())), prefix
+
+# GOG Galaxy keeps a copy of the cloud saves of each game here, in Storage, by the client id of the game, even for games
+# that keep their saves somewhere else, so restoring them brings the saves back when Galaxy isn't there anymore
+GOG_APPLICATIONS = Path("AppData/Local/GOG.com/Galaxy/Applications")
+# where GOG Galaxy, the offline installers and Heroic put games, relative to the drive or the home
+GOG_LIBRARIES = ["GOG Games", "Program Files (x86)/GOG Galaxy/Games", "Program Files/GOG Galaxy/Games"]
+GOG_HOME_LIBRARIES = ["Games/Heroic", "GOG Games"]
+
+def find_gog_games():
+    # the goggame-<id>.info of each installed game has its name and the client id of its cloud saves
+    import json
+    folders = [install_dir for app in sorted(apps) for install_dir in get_paths(app, 'installdir')]
+    drives = [prefix / "drive_c" for prefix in get_wine_prefixes()]
+    if sys.platform == "win32":
+        drives.append(Path(os.environ.get("SystemDrive", "C:") + "/"))
+    libraries = [drive / library for drive in drives for library in GOG_LIBRARIES]
+    libraries += [homedir / library for homedir in get_homes() for library in GOG_HOME_LIBRARIES]
+    folders += [game for library in libraries if library.is_dir() for game in sorted(library.iterdir()) if game.is_dir()]
+    for folder in dedup_paths(folders):
+        for info_file in sorted(folder.glob("goggame-*.info")) if folder.is_dir() else []:
+            try:
+                game_info = json.loads(info_file.read_text(encoding="utf-8-sig"))
+            except (OSError, ValueError) as e:
+                warn(f"not reading '{info_file}': {e}")
+                continue
+            if game_info.get("clientId") is not None:
+                yield str(game_info["clientId"]), game_info.get("name") or folder.name, folder
+
+def gog_import():
+    # the cloud save folders of this machine are matched with the installed games and their ids written to the config
+    storages = {}
+    for homedir in get_homes():
+        applications = homedir / GOG_APPLICATIONS
+        for application in sorted(applications.iterdir()) if applications.is_dir() else []:
+            if (application / "Storage").is_dir():
+                storages.setdefault(application.name, application / "Storage")
+    if len(storages) == 0:
+        print("No GOG Galaxy cloud saves on this machine")
+        return
+    games = {}
+    for client_id, name, folder in find_gog_games():
+        games.setdefault(client_id, (name, folder))
+    imported = 0
+    for client_id, storage in sorted(storages.items()):
+        if client_id not in games:
+            print(f"'{storage}' is of a game that isn't installed, set gog_client_id={client_id} in the section of its app to back it up")
+            continue
+        name, folder = games[client_id]
+        # the app whose installdir is the folder of the game, or the one named like ludusavi names it
+        matches = [app for app in sorted(apps) if any(install_dir.resolve() == folder.resolve() for install_dir in get_paths(app, 'installdir'))]
+        app = matches[0] if len(matches) > 0 else ludusavi_app_name(name)
+        client_ids = get_list(app, 'gog_client_id') or []
+        if client_id in [existing.strip() for existing in client_ids]:
+            debug(f"{name} is already {app}")
+            continue
+        imported += 1
+        if args.dry_run:
+            print(f"Would import the cloud saves of {name} in '{storage}' to {app}")
+            continue
+        config_edit("set", f"{app}.gog_client_id", get_str('general', 'divider').join([*client_ids, client_id]))
+        print(f"Imported the cloud saves of {name} to {app}{'' if app in apps else ', a new app'}")
+    print(f"{imported} games {'would be' if args.dry_run else 'were'} imported, {len(storages)} have GOG Galaxy cloud saves on this machine")
+
+def load_transfer():
+    return load_meta("transfer.json", {})
+
+def save_transfer(transfer: dict):
+    # what this machine uploaded, written after the push, so it stays out of git
+    save_meta("transfer.json", transfer)
+    ignore_file = META_DIR / ".gitignore"
+    if not ignore_file.exists():
+        ignore_file.write_text("transfer.json\n")
+
+def check_transfer_quota():
+    # what gets copied in a run is what gets uploaded by the remote, so it's a good estimate of the transfer
+    # the bytes of the runs that weren't uploaded, held back by the quota or by a failed push, go with the next upload
+    from datetime import date
+    transfer = load_transfer()
+    # only what this run copied counts for max_upload_per_run, otherwise a run held back by it would hold back every
+    # later one too
+    run_bytes = run_stats["bytes_copied"]
+    pending = transfer.get("pending", 0) + run_bytes
+    transfer["pending"] = pending
+    save_transfer(transfer)
+    month_bytes = transfer.get(date.today().strftime("%Y-%m"), 0)
+    max_upload_per_run = get_size('remote', 'max_upload_per_run')
+    if max_upload_per_run is not None and run_bytes > max_upload_per_run:
+        warn(f"not pushing: this run copied {format_size(run_bytes)}, more than max_upload_per_run={format_size(max_upload_per_run)}, it goes with the next push")
+        return False
+    monthly_quota = get_size('remote', 'monthly_quota')
+    if monthly_quota is not None:
+        if month_bytes + pending > monthly_quota:
+            warn(f"not pushing: {format_size(pending)} are waiting to be uploaded and {format_size(month_bytes)} were already uploaded this month, more than monthly_quota={format_size(monthly_quota)}")
+            return False
+        if month_bytes + pending > monthly_quota * 0.8:
+            warn(f"{format_size(month_bytes + pending)} of the {format_size(monthly_quota)} monthly quota used")
+    return True
+
+def account_transfer():
+    # only what reached the remote counts for the month
+    from datetime import date
+    transfer = load_transfer()
+    month = date.today().strftime("%Y-%m")
+    transfer[month] = transfer.get(month, 0) + transfer.pop("pending", 0)
+    save_transfer(transfer)
+
+def parse_vdf(text: str):
+    # Valve's KeyValues format: "key" "value" pairs and "key" { ... } blocks
+    tokens = re.findall(r'"((?:[^"\\]|\\.)*)"|([{}])', text)
+    stack = [{}]
+    key = None
+    for quoted, brace in tokens:
+        if brace == "{":
+            child = {}
+            stack[-1][key] = child
+            stack.append(child)
+            key = None
+        elif brace == "}":
+            stack.pop()
+        elif key is None:
+            key = quoted.replace('\\\\', '\\')
+        else:
+            stack[-1][key] = quoted.replace('\\\\', '\\')
+            key = None
+    return stack[0]
+
+# where Steam is installed, relative to a home
+STEAM_HOME_ROOTS = [
+    ".local/share/Steam",
+    ".steam/steam",
+    ".var/app/com.valvesoftware.Steam/.local/share/Steam",
+    "Library/Application Support/Steam",
+]
+# SteamID64 of the account 0, the userdata folders are named after the account id
+STEAM_ID64_BASE = 76561197960265728
+
+def get_steam_roots():
+    candidates = get_paths('steam', 'paths')
+    for homedir in get_base_homes():
+        candidates.extend(homedir / root for root in STEAM_HOME_ROOTS)
+        # Windows homes inside a drive_c, like in Wine and Proton prefixes
+        if homedir.parent.name.lower() == "users":
+            candidates.append(homedir.parents[1] / "Program Files (x86)" / "Steam")
+    if sys.platform == "win32":
+        candidates.append(Path(os.environ.get("ProgramFiles(x86)", "C:/Program Files (x86)")) / "Steam")
+    seen = set()
+    for candidate in candidates:
+        if not (candidate / "steamapps").is_dir():
+            continue
+        resolved = candidate.resolve()
+        if resolved in seen:
+            continue
+        seen.add(resolved)
+        yield resolved
+
+def get_steam_libraries(steam_root: Path):
+    libraries = [steam_root / "steamapps"]
+    library_folders = steam_root / "steamapps" / "libraryfolders.vdf"
+    if library_folders.exists():
+        folders = parse_vdf(library_folders.read_text(errors='replace')).get("libraryfolders", {})
+        for folder in folders.values():
+            path = folder.get("path") if isinstance(folder, dict) else folder
+            if path is None:
+                continue
+            steamapps = Path(path) / "steamapps"
+            if steamapps.is_dir() and steamapps.resolve() not in [library.resolve() for library in libraries]:
+                libraries.append(steamapps)
+    return libraries
+
+def get_steam_installed_games():
+    # install folder name of each installed app id, from the appmanifest files of each library
+    if not hasattr(get_steam_installed_games, "cached"):
+        games = {}
+        for steam_root in get_steam_roots():
+            for library in get_steam_libraries(steam_root):
+                for app_manifest in library.glob("appmanifest_*.acf"):
+                    state = parse_vdf(app_manifest.read_text(errors='replace')).get("AppState", {})
+                    if state.get("appid") is not None and state.get("installdir") is not None:
+                        games[state["appid"]] = state["installdir"]
+        get_steam_installed_games.cached = games
+    return get_steam_installed_games.cached
+
+def get_app_steam_ids(app: str):
+    # steam_appid in the app section, the manifest, or rules pointing inside $steamapps/common of an installed game
+    ids = get_list(app, 'steam_appid') or manifest_steam_ids.get(app, [])
+    if len(ids) > 0:
+        return ids
+    install_dirs = set()
+    for rule_name, rule_path in parse_rules(app):
+        match = re.match(r'\$steamapps/common/([^/]+)', rule_path)
+        if match is not None:
+            install_dirs.add(match.group(1).lower())
+    return [appid for appid, install_dir in get_steam_installed_games().items() if install_dir.lower() in install_dirs]
+
+def get_proton_prefixes(app: str):
+    prefixes = []
+    for steam_root in get_steam_roots():
+        for library in get_steam_libraries(steam_root):
+            for appid in get_app_steam_ids(app):
+                prefix = library / "compatdata" / appid / "pfx"
+                if (prefix / "drive_c").is_dir():
+                    prefixes.append(prefix.resolve())
+    return prefixes
+
+def get_steam_users(steam_root: Path):
+    users = set()
+    login_users = steam_root / "config" / "loginusers.vdf"
+    if login_users.exists():
+        for steam_id in parse_vdf(login_users.read_text(errors='replace')).get("users", {}).keys():
+            if steam_id.isdigit():
+                users.add(str(int(steam_id) - STEAM_ID64_BASE))
+    userdata = steam_root / "userdata"
+    if userdata.is_dir():
+        users.update(item.name for item in userdata.iterdir() if item.name.isdigit() and item.name != "0")
+    if get_output_layout() == "per_user":
+        # accounts mapped to other profiles in [household] are theirs, the ones not mapped are of whoever runs this
+        for user in sorted(users):
+            profile = get_str('household', user) or get_str('household', str(int(user) + STEAM_ID64_BASE))
+            if profile is not None and profile != get_profile():
+                debug(f"Skipping the Steam account {user}: it is of the profile {profile}")
+                users.discard(user)
+    return [userdata / user for user in sorted(users) if (userdata / user).is_dir()]
+
+def get_steam_personas(steam_root: Path):
+    # persona and account name of each account id that logged in on this Steam
+    personas = {}
+    login_users = steam_root / "config" / "loginusers.vdf"
+    if login_users.is_file():
+        for steam_id, user in parse_vdf(login_users.read_text(errors='replace')).get("users", {}).items():
+            if steam_id.isdigit() and isinstance(user, dict):
+                personas[str(int(steam_id) - STEAM_ID64_BASE)] = dict(persona=user.get("PersonaName"), account=user.get("AccountName"))
+    return personas
+
+def describe_steam_account(account_id: str, persona: dict):
+    return f"{account_id} ({persona['persona']})" if persona.get("persona") else account_id
+
+# the userdata folder of the Steam account the saves of each app were backed up from
+steam_accounts = {}
+
+def save_steam_accounts():
+    # the account ids are different on each account, restore needs to know which one the saves are of
+    if len(steam_accounts) == 0:
+        return
+    recorded = load_meta("steam_accounts.json", dict(accounts={}, apps={}))
+    for app, userdata in steam_accounts.items():
+        recorded["apps"][app] = userdata.name
+        persona = get_steam_personas(userdata.parents[1]).get(userdata.name)
+        if persona is not None:
+            recorded["accounts"][userdata.name] = persona
+    save_meta("steam_accounts.json", recorded)
+
+def pick_steam_accounts(resolved_rules):
+    # rules in userdata resolve once for each account, the saves go to the one given with --steam-account, else to the
+    # one they were backed up from when it is on this machine, else the usual picking of restore targets decides
+    recorded = load_meta("steam_accounts.json", dict(accounts={}, apps={}))
+    picked = []
+    by_app = {}
+    for resolved_rule in resolved_rules:
+        if "steamuserdata" in resolved_rule[4]:
+            by_app.setdefault(resolved_rule[0], []).append(resolved_rule)
+        else:
+            picked.append(resolved_rule)
+    for app, app_rules in by_app.items():
+        local = sorted(set(Path(resolved_rule[4]["steamuserdata"]) for resolved_rule in app_rules))
+        personas = {userdata.name: get_steam_personas(userdata.parents[1]).get(userdata.name, {}) for userdata in local}
+        source = recorded["apps"].get(app)
+        if args.steam_account is not None:
+            accounts = [userdata for userdata in local if args.steam_account in [userdata.name, str(int(userdata.name) + STEAM_ID64_BASE), *personas[userdata.name].values()]]
+            assert len(accounts) > 0, f"no Steam account '{args.steam_account}' for {app} on this machine, available: {', '.join(describe_steam_account(userdata.name, personas[userdata.name]) for userdata in local)}"
+        else:
+            accounts = [userdata for userdata in local if userdata.name == source] or local
+        if source is not None and len(accounts) == 1 and accounts[0].name != source:
+            print(f"Restoring the Steam saves of {app} of the account {describe_steam_account(source, recorded['accounts'].get(source, {}))} to {describe_steam_account(accounts[0].name, personas[accounts[0].name])}")
+        picked.extend(resolved_rule for resolved_rule in app_rules if Path(resolved_rule[4]["steamuserdata"]) in accounts)
+    return picked
+
+def resolve_steam_rules():
+    for steam_root in get_steam_roots():
+        debug(f"Looking for stuff in Steam at {str(steam_root)}")
+        values = dict(
+            steam=[steam_root],
+            steamapps=get_steam_libraries(steam_root),
+            steamuserdata=get_steam_users(steam_root),
+        )
+        for var, paths in values.items():
+            for game in sorted(var_users.get(var) or []):
+                for value in paths:
+                    for rule_name, rule_path in parse_rules(game):
+                        resolved_rule_path = substitute_variable(rule_path, var, str(value))
+                        if rule_path == resolved_rule_path:
+                            continue
+                        yield game, rule_name, None, resolved_rule_path, {var: str(value)}, steam_root
+
+def resolve_rules():
+    # yields (app, rule_name, kind, target, variables, base) for everything a backup looks at
+    # base is the folder whose owner the sources are read as
+    for game in sorted(var_users.get('installdir') or []):
+        game_install_dirs = get_paths(game, 'installdir')
+        if game_install_dirs is None:
+            if get_str(game, 'not_installed') is None:
+                info(f"installdir missing for game {game}, please add it in the game configuration section or set anything to not_installed to disable this warning")
+            continue
+        for game_install_dir in game_install_dirs:
+            base = game_install_dir if game_install_dir.exists() else None
+            for rule_name, rule_path in parse_rules(game):
+                resolved_rule_path = substitute_variable(rule_path, 'installdir', str(game_install_dir.resolve()))
+                if rule_path == resolved_rule_path:
+                    continue
+                yield game, rule_name, None, resolved_rule_path, dict(installdir=str(game_install_dir.resolve())), base
+
+    for homedir in get_homes():
+        debug(f"Looking for stuff in {str(homedir)}")
+        for game in sorted(var_users.get('home') or []):
+            for rule_name, rule_path in parse_rules(game):
+                resolved_rule_path = substitute_variable(rule_path, 'home', str(homedir.resolve()))
+                if rule_path == resolved_rule_path:
+                    continue
+                yield game, rule_name, None, resolved_rule_path, dict(home=str(homedir.resolve())), homedir
+
+        appdata = homedir / "AppData"
+        for game in sorted(var_users.get('appdata') or []):
+            for rule_name, rule_path in parse_rules(game):
+                resolved_rule_path = substitute_variable(rule_path, 'appdata', str(appdata.resolve()))
+                if rule_path == resolved_rule_path:
+                    continue
+                yield game, rule_name, None, resolved_rule_path, dict(home=str(homedir.resolve()), appdata=str(appdata.resolve())), homedir
+
+        for var in XDG_VARIABLES:
+            xdg_dir = get_xdg_dir(homedir, var)
+            for game in sorted(var_users.get(var) or []):
+                for rule_name, rule_path in parse_rules(game):
+                    resolved_rule_path = substitute_variable(rule_path, var, str(xdg_dir))
+                    if rule_path == resolved_rule_path:
+                        continue
+                    yield game, rule_name, None, resolved_rule_path, {"home": str(homedir.resolve()), var: str(xdg_dir)}, homedir
+
+        for app, rule_name, kind, target in special_rules:
+            if kind == "browser":
+                yield app, rule_name, kind, target, dict(home=str(homedir.resolve())), homedir
+
+        for game in sorted(var_users.get('gog_cloud') or []):
+            for client_id in get_list(game, 'gog_client_id') or []:
+                storage = homedir / GOG_APPLICATIONS / client_id.strip() / "Storage"
+                for rule_name, rule_path in parse_rules(game):
+                    resolved_rule_path = substitute_variable(rule_path, 'gog_cloud', str(storage.resolve()))
+                    if rule_path == resolved_rule_path:
+                        continue
+                    # each client id gets a folder in the rule, so the saves of one don't overwrite the ones of another
+                    yield game, f"{rule_name}/{client_id.strip()}", None, resolved_rule_path, dict(home=str(homedir.resolve()), gog_cloud=str(storage.resolve())), homedir
+
+        library = homedir / "Library"
+        if (library / "Application Support").is_dir():
+            for var, folder in [("library", library), ("application_support", library / "Application Support")]:
+                for game in sorted(var_users.get(var) or []):
+                    for rule_name, rule_path in parse_rules(game):
+                        resolved_rule_path = substitute_variable(rule_path, var, str(folder.resolve()))
+                        if rule_path == resolved_rule_path:
+                            continue
+                        yield game, rule_name, None, resolved_rule_path, {"home": str(homedir.resolve()), var: str(folder.resolve())}, homedir
+
+        for documents_candidate in [ "Documentos", "Documents" ]:
+            documents = homedir / documents_candidate
+            if not documents.exists():
+                continue
+            for game in sorted(var_users.get('documents') or []):
+                for rule_name, rule_path in parse_rules(game):
+                    resolved_rule_path = substitute_variable(rule_path, 'documents', str(documents.resolve()))
+                    if rule_path == resolved_rule_path:
+                        continue
+                    yield game, rule_name, None, resolved_rule_path, dict(home=str(homedir.resolve()), documents=str(documents.resolve())), homedir
+
+    yield from resolve_steam_rules()
+    yield from resolve_wine_rules()
+
+    for app, rule_name, kind, target in special_rules:
+        if kind != "browser":
+            yield app, rule_name, kind, target, {}, None
+
+    for app, rule_name, path, base in plain_rules:
+        yield app, rule_name, None, path, {}, base
+
+def rule_root(target: str, variables: dict, base: Path):
+    # the folder a rule is about, the one its variable resolved to, relative rules are about their root
+    if len(variables) == 0:
+        return base
+    roots = [value for value in variables.values() if target.startswith(value)]
+    return Path(max(roots, key=len)) if len(roots) > 0 else None
+
+def is_inside(path: Path, root: Path):
+    return path == root or root in path.parents
+
+def is_contained(app: str, rule_name: str, path: Path, root: Path):
+    # rules can't reach out of their root with .. or with symlinks that point out of it
+    if not is_inside(Path(os.path.normpath(path)), root):
+        return security_violation(app, rule_name, path, "traversal", f"it is out of '{root}' through ..")
+    if os.path.lexists(path) and not is_inside(path.resolve(), root.resolve()):
+        if get_bool(app, 'follow_symlinks_out') or get_bool('security', 'follow_symlinks_out'):
+            # like a save folder moved to another disk and linked back, the link is in the folder of the rule
+            debug(f"'{path}' is out of '{root}' through a symlink, followed because of follow_symlinks_out")
+            return True
+        return security_violation(app, rule_name, path, "symlink", f"it is out of '{root}' through a symlink, set follow_symlinks_out in [{app}] if it is yours")
+    return True
+
+# strict skips the rest of the app, warn only warns and off allows everything, for self written rules that are trusted
+SECURITY_MODES = ["strict", "warn", "off"]
+SECURITY_LOG = "security.jsonl"
+# apps that had a violation in strict mode, nothing more of them is done in this run
+blocked_apps = set()
+
+def get_security_mode():
+    mode = get_str('security', 'mode') or "strict"
+    assert mode in SECURITY_MODES, f"invalid security mode '{mode}', available: {', '.join(SECURITY_MODES)}"
+    return mode
+
+def security_violation(app: str, rule_name: str, path, reason: str, explanation: str):
+    # every decision goes to __meta__/security.jsonl, returns if the path can be used
+    import json
+    mode = get_security_mode()
+    allowed = mode != "strict"
+    make_dirs(META_DIR)
+    with (META_DIR / SECURITY_LOG).open('a') as log:
+        log.write(json.dumps(dict(time=format_timestamp(now()), machine_id=get_machine_id(), app=app, rule=rule_name, path=str(path), reason=reason, mode=mode, allowed=allowed), sort_keys=True) + "\n")
+    set_file_mode(META_DIR / SECURITY_LOG)
+    if mode == "off":
+        return True
+    if allowed:
+        warn(f"using '{path}' even though {explanation}, security mode is warn")
+    else:
+        warn(f"not using '{path}' and the rest of {app}: {explanation}")
+        blocked_apps.add(app)
+    emit("security", app=app, rule=rule_name, path=str(path), reason=reason, allowed=allowed)
+    return allowed
+
+def ingest_resolved(app: str, rule_name: str, kind: str, target: str, variables: dict, base: Path):
+    if app in blocked_apps:
+        return
+    set_source_owner(base)
+    with log_scope(app=app, rule=rule_name, home=base):
+        if kind is None and len(variables) == 0 and base is None:
+            # an absolute path can point anywhere
+            if security_violation(app, rule_name, target, "absolute", "the rule is an absolute path"):
+                ingest_path(app, rule_name, target)
+        elif kind is None:
+            if "steamuserdata" in variables and rule_target_exists(kind, target, variables):
+                steam_accounts[app] = Path(variables["steamuserdata"])
+            ingest_path(app, rule_name, target, variables=variables, root=rule_root(target, variables, base))
+        elif kind == "browser":
+            ingest_browser(app, rule_name, target, Path(variables["home"]))
+        else:
+            ingest_special(app, rule_name, kind, target)
+    set_source_owner(None)
+
+def confirm(question: str):
+    if args.yes:
+        return True
+    if not sys.stdin.isatty():
+        return False
+    return input(f"{question} [y/N] ").strip().lower() in ["y", "yes"]
+
+def has_files(path: Path):
+    return path.is_file() or any(item.is_file() for item in path.rglob('*'))
+
+def find_free_slot(destination: Path, slots):
+    # the slot a backed up save goes to instead of overwriting a different local one, None if the game has no free slot
+    template, count = slots
+    for n in range(1, count + 1):
+        candidate = destination.parent / template.format(n=n)
+        if not candidate.exists():
+            return candidate
+    return None
+
+def restore_item(backup: Path, destination: Path, depth=0, transform=None, slots=None):
+    if backup.is_dir():
+        if not has_files(backup):
+            # folders of rules that never matched anything are created empty in the output
+            return
+        if (backup / ARCHIVE_NAME).is_file():
+            restore_archive(backup / ARCHIVE_NAME, destination, depth=depth, transform=transform, slots=slots)
+            return
+        if destination.exists() and not destination.is_dir():
+            warn(f"not restoring '{backup}': '{destination}' is not a folder", depth=depth)
+            return
+        with as_source_owner(), as_user_umask():
+            destination.mkdir(exist_ok=True, parents=True)
+        for item in sorted(backup.iterdir()):
+            name = item.name
+            if CONFLICT_INFIX in name:
+                debug(f"Not restoring '{item}': it's the version of another machine kept by keep-both", depth=depth+1)
+                continue
+            if name == NESTED_GIT_RENAMED and get_nested_git_policy() == "rename":
+                name = ".git"
+            restore_item(item, destination / name, depth=depth+1, transform=transform, slots=slots)
+        return
+    live = None
+    if destination.exists():
+        if destination.is_dir():
+            warn(f"not restoring '{backup}': '{destination}' is a folder", depth=depth)
+            return
+        with as_source_owner():
+            live = destination.read_bytes()
+    data = decrypt_bytes(backup.read_bytes())
+    if transform is not None:
+        data = transform_bytes(data, destination.name, transform, live=live)
+    # the files of archives are unpacked elsewhere, they are not in the manifest
+    manifest_key = backup.relative_to(args.output).as_posix() if str(backup).startswith(str(args.output) + os.sep) else None
+    if live is not None:
+        if live == data:
+            debug(f"Not restoring '{destination}': Didn't change", depth=depth)
+            if manifest_key is not None:
+                mark_synced(manifest_key, hash_file(destination))
+            return
+        if slots is not None and re.fullmatch(re.escape(slots[0]).replace(re.escape("{n}"), "[0-9]+"), destination.name):
+            # the local slot has another save, it is kept and the backed up one goes to a free slot
+            if any((destination.parent / slots[0].format(n=n)).is_file() and (destination.parent / slots[0].format(n=n)).read_bytes() == data for n in range(1, slots[1] + 1)):
+                debug(f"Not restoring '{backup}': already in another slot", depth=depth)
+                return
+            free_slot = find_free_slot(destination, slots)
+            if free_slot is None:
+                warn(f"not restoring '{backup}': '{destination}' has another save and there are no free slots", depth=depth)
+                return
+            destination = free_slot
+            live = None
+    if live is not None and destination.stat().st_mtime > backup.stat().st_mtime:
+        choice = None
+        if args.on_conflict == "ask":
+            import hashlib
+            entry = get_manifest().get(manifest_key, {}) if manifest_key is not None else {}
+            try:
+                rule = "/".join(backup.relative_to(APPS_DIR).parts[:2])
+                save = inspect_save(backup, destination)
+            except ValueError:
+                rule, save = None, None
+            ours = dict(hostname=get_hostname(), size=len(live), mtime=destination.stat().st_mtime, hash=f"sha256:{hashlib.sha256(live).hexdigest()}", save=save)
+            theirs = dict(hostname=entry.get("hostname", "the backup"), size=len(data), mtime=backup.stat().st_mtime, hash=f"sha256:{hashlib.sha256(data).hexdigest()}", save=entry.get("save"))
+            # a copy next to the save would be loaded by the game, what restore overwrites is kept in __backup__ anyway
+            choice = ask_conflict(manifest_key or str(destination), rule, ours, theirs, both=False)
+        if choice == "ours" or choice is None and not confirm(f"'{destination}' is newer than the backup, overwrite it?"):
+            warn(f"not restoring '{destination}': it's newer than the backup", depth=depth)
+            return
+    if live is not None:
+        backup_item(destination)
+    print((" "*depth) + f"Restoring '{backup}' to '{destination}'")
+    # written as the owner of the home, running as root the files would be root's and the game couldn't write them
+    # the permissions are of the home, not of the output, only the times of the backup are kept, games sort saves by them
+    backup_stat = backup.stat()
+    with as_source_owner(), as_user_umask():
+        destination.parent.mkdir(exist_ok=True, parents=True)
+        destination.write_bytes(data)
+        os.utime(destination, ns=(backup_stat.st_atime_ns, backup_stat.st_mtime_ns))
+    if manifest_key is not None:
+        mark_synced(manifest_key, hash_file(destination))
+
+def restore_archive(archive: Path, destination: Path, depth=0, transform=None, slots=None):
+    # unpacked to a temporary folder so the files go through the same checks as the ones that are not archived
+    import io
+    import tarfile
+    from tempfile import TemporaryDirectory
+    with TemporaryDirectory() as unpacked, tarfile.open(fileobj=io.BytesIO(decrypt_bytes(archive.read_bytes())), mode='r:gz') as tar:
+        # the data filter refuses links and paths that leave the folder, older pythons don't have it
+        tar.extractall(unpacked, **(dict(filter='data') if hasattr(tarfile, 'data_filter') else {}))
+        restore_item(Path(unpacked), destination, depth=depth, transform=transform, slots=slots)
+
+def restore_path(app: str, rule_name: str, path: str, variables: dict):
+    from fnmatch import fnmatch
+    path = fix_path_case(app, path)
+    backup_dir = APPS_DIR / app / rule_name
+    ppath = Path(path)
+    slots = get_rule_slots(app, rule_name) if args.free_slots or get_bool(app, f"free_slots_{Path(rule_name).parts[0]}") else None
+    if "*" in path:
+        # each match of the glob was backed up with its name
+        for item in sorted(backup_dir.iterdir()):
+            if fnmatch(item.name, ppath.name):
+                restore_item(item, ppath.parent / item.name, transform=get_transform(app, rule_name, variables, reverse=True), slots=slots)
+        return
+    entries = list(backup_dir.iterdir())
+    transform = get_transform(app, rule_name, variables, reverse=True)
+    # a rule that points to a file has only that file in its folder
+    if ppath.is_file() or (not ppath.exists() and len(entries) == 1 and entries[0].name == ppath.name and entries[0].is_file()):
+        restore_item(backup_dir / ppath.name, ppath, transform=transform, slots=slots)
+    else:
+        restore_item(backup_dir, ppath, transform=transform, slots=slots)
+
+def restore_browser(app: str, rule_name: str, origin: str, homedir: Path):
+    for browser, profile in find_browser_profiles(homedir):
+        backup_dir = APPS_DIR / app / rule_name / f"{browser}-{profile.name}"
+        if not backup_dir.is_dir():
+            continue
+        for storage in browser_origin_storage(browser, profile, origin):
+            if (backup_dir / storage.name).exists():
+                restore_item(backup_dir / storage.name, storage)
+
+def get_remaps():
+    # (old, new) prefixes of paths from the machine the backup came from and where they are on this one
+    remaps = []
+    for item in get_list('remap', 'paths') or []:
+        old, separator, new = item.partition('=')
+        assert separator != "", f"invalid remap '{item}', use old=new like /home/olduser=/home/newuser"
+        # /home/olduser/ is /home/olduser, the separator after it is part of the rest of the path
+        old, new = old.strip().rstrip('/\\'), new.strip().rstrip('/\\')
+        assert old != "" and new != "", f"invalid remap '{item}', the root can't be remapped"
+        remaps.append((old, new))
+    return remaps
+
+def replace_folder(path: str, old: str, new: str):
+    # path with the folder old changed to new, /home/a is not the start of /home/ab
+    if path == old or path.startswith(old + '/') or path.startswith(old + '\\'):
+        return new + path[len(old):]
+    return None
+
+def replace_folder_in_text(text: str, old: str, new: str):
+    # only whole folders are replaced, /home/a is not the start of /home/ab or of /mnt/home/a
+    return re.sub(rf'(?<![\w.\-]){re.escape(old)}(?![\w.\-])', lambda match: new, text)
+
+def remap_path(path: str):
+    for old, new in get_remaps():
+        remapped = replace_folder(path, old, new)
+        if remapped is not None:
+            return remapped
+    return path
+
+def remap_text(text: str):
+    # absolute paths inside text files, like recent files lists, point to the old layout too, for the rules with the
+    # remap_paths transform
+    for old, new in get_remaps():
+        text = replace_folder_in_text(text, old, new)
+    return text
+
+def pick_restore_targets(resolved_rules):
+    # a rule can resolve to many places, like one per home, the backup goes to the one that looks in use
+    # saves of a Windows game restored on Linux go to the Proton prefix of that game, not the prefix of any other game
+    candidates = {}
+    for resolved_rule in resolved_rules:
+        app, rule_name, kind, target, variables, base = resolved_rule
+        candidates.setdefault((app, rule_name, kind), []).append(resolved_rule)
+    for (app, rule_name, kind), options in candidates.items():
+        proton_prefixes = get_proton_prefixes(app) if kind is None else []
+        def score(resolved_rule):
+            kind, target = resolved_rule[2], resolved_rule[3]
+            if kind is not None or "*" in target:
+                return (0, 0)
+            # how many folders would have to be created, the fewer the more likely the game uses that place
+            missing = 0
+            existing = Path(target)
+            while not existing.exists() and existing != existing.parent:
+                existing = existing.parent
+                missing += 1
+            if missing == 0:
+                return (0, 0)
+            if any(str(Path(target).resolve()).startswith(str(prefix) + os.sep) for prefix in proton_prefixes):
+                return (1, missing)
+            return (2, missing)
+        yield sorted(options, key=score)[0]
+
+TELEMETRY_INTERVAL = 7 * 86400
+
+def telemetry_file():
+    # enabled per machine, a config shared between machines doesn't enable it for all of them
+    return get_state_dir() / "telemetry.json"
+
+def telemetry_payload():
+    # everything that is sent: the version of the format and the apps with rules shipped with cloud-savegame that were
+    # backed up on this machine, no paths, hostnames, machine ids, apps from manifests or file names
+    backed_up = load_meta("coverage.json", {}).get(get_machine_id(), {})
+    return dict(version=META_VERSION, apps=sorted(app for app in backed_up if (RULES_DIR / f"{app}.txt").exists()))
+
+def send_telemetry():
+    # at most once a week, only when enabled on this machine and an endpoint is set, failures are not a problem of the run
+    import json
+    from urllib.request import Request, urlopen
+    state = json.loads(telemetry_file().read_text()) if telemetry_file().is_file() else {}
+    endpoint = get_str('telemetry', 'endpoint')
+    if not state.get("enabled") or endpoint is None or now().timestamp() - state.get("last_sent", 0) < TELEMETRY_INTERVAL:
+        return
+    request = Request(endpoint, data=json.dumps(telemetry_payload()).encode(), headers={"Content-Type": "application/json"})
+    try:
+        urlopen(request, timeout=10).close()
+    except OSError as e:
+        debug(f"Not sending telemetry: {e}")
+        return
+    state["last_sent"] = now().timestamp()
+    telemetry_file().write_text(json.dumps(state))
+
+def telemetry():
+    import json
+    state = json.loads(telemetry_file().read_text()) if telemetry_file().is_file() else {}
+    if args.action != "status":
+        state["enabled"] = args.action == "enable"
+        telemetry_file().parent.mkdir(exist_ok=True, parents=True)
+        telemetry_file().write_text(json.dumps(state))
+    endpoint = get_str('telemetry', 'endpoint')
+    print(f"telemetry is {'enabled' if state.get('enabled') else 'disabled'} on this machine")
+    if endpoint is None:
+        print("nothing is sent while endpoint in [telemetry] is not set")
+    else:
+        print(f"sent at most once a week to {endpoint}")
+    print("payload:")
+    print(json.dumps(telemetry_payload(), indent=2))
+
+def merge():
+    from shutil import copy2
+    assert get_output_layout() == "per_host", "merge needs layout=per_host in [output]"
+    source_dir = get_host_dir(args.host)
+    assert source_dir.is_dir(), f"there is no folder of '{args.host}' in the output"
+    assert source_dir != APPS_DIR, "can't merge the folder of this machine into itself"
+    for app in args.apps:
+        assert app in apps, f"unknown app '{app}'"
+    merged = 0
+    for app_dir in sorted(source_dir.iterdir()):
+        if not app_dir.is_dir() or app_dir.name not in apps or len(args.apps) > 0 and app_dir.name not in args.apps:
+            continue
+        for item in sorted(app_dir.rglob('*')):
+            if not item.is_file():
+                continue
+            destination = APPS_DIR / item.relative_to(source_dir)
+            if destination.exists():
+                if destination.read_bytes() == item.read_bytes():
+                    continue
+                if destination.stat().st_mtime >= item.stat().st_mtime:
+                    debug(f"Not merging '{item}': the version of {get_hostname()} is newer")
+                    continue
+            merged += 1
+            if args.dry_run:
+                print(f"Would merge '{item}' to '{destination}'")
+                continue
+            print(f"Merging '{item}' to '{destination}'")
+            backup_item(destination)
+            make_dirs(destination.parent)
+            # replaced instead of written over, the file can be a hard link of staging or of the blob store
+            copy2(item, temp_path(destination))
+            os.replace(temp_path(destination), destination)
+            set_file_mode(destination)
+            entry = get_manifest().get(item.relative_to(args.output).as_posix())
+            if entry is not None:
+                get_manifest()[destination.relative_to(args.output).as_posix()] = dict(entry)
+                dedup_file(destination, entry["hash"])
+    if args.dry_run:
+        print(f"{merged} files would be merged")
+        return
+    save_manifest()
+    git_commit_if_dirty(f"merge from={args.host} to={get_hostname()}")
+    print_undo_instructions()
+    print(f"Merged {merged} files of {args.host}")
+
+read_only_mounts = set()
+
+def restore_at():
+    # the apps of the snapshot are unpacked elsewhere and restored from there, the output stays as it is
+    global APPS_DIR
+    import io
+    import tarfile
+    from tempfile import TemporaryDirectory
+    assert git_bin is not None and (args.output / ".git").exists(), "--at needs the output to be a git repo, made with -g"
+    commit = git_output("rev-parse", "--verify", f"{args.at}^{{commit}}").decode().strip()
+    prefix = APPS_DIR.relative_to(args.output)
+    snapshot = git_output("archive", "--format=tar", commit, "--", prefix.as_posix())
+    with TemporaryDirectory() as unpacked, tarfile.open(fileobj=io.BytesIO(snapshot)) as tar:
+        tar.extractall(unpacked, **(dict(filter='data') if hasattr(tarfile, 'data_filter') else {}))
+        APPS_DIR = Path(unpacked) / prefix
+        print(f"Restoring the snapshot {commit[:12]}")
+        restore()
+
+def restore():
+    assert args.from_host is None or get_output_layout() == "per_host", "--from-host needs layout=per_host in [output]"
+    assert args.profile is None or get_output_layout() == "per_user", "--profile needs layout=per_user in [output]"
+    assert args.profile is None or APPS_DIR.is_dir(), f"there is no folder of the profile '{args.profile}' in the output"
+    if args.profile not in [None, get_profile()] and not confirm(f"Restore the saves of the profile {args.profile} over the ones of {get_profile()}?"):
+        print("Nothing restored")
+        return
+    backed_up_apps = sorted(item.name for item in APPS_DIR.iterdir() if item.is_dir() and item.name in apps) if APPS_DIR.is_dir() else []
+    selected_apps = args.apps or backed_up_apps
+    for app in selected_apps:
+        assert app in apps, f"unknown app '{app}'"
+    if len(args.apps) == 0 and not confirm(f"Restore all the {len(backed_up_apps)} backed up apps?"):
+        print("Nothing restored")
+        return
+    resolved_rules = [(app, rule_name, kind, remap_path(target) if kind is None else target, variables, base) for app, rule_name, kind, target, variables, base in resolve_rules() if app in selected_apps]
+    for app, rule_name, kind, target, variables, base in pick_restore_targets(pick_steam_accounts(resolved_rules)):
+        if not (APPS_DIR / app / rule_name).exists() or not has_files(APPS_DIR / app / rule_name):
+            continue
+        set_source_owner(base)
+        with log_scope(app=app, rule=rule_name, home=base):
+            debug(f"restore to '{target}'")
+            root = rule_root(target, variables, base) if kind is None else None
+            if app in blocked_apps or root is not None and not is_contained(app, rule_name, Path(target), root):
+                continue
+            read_only_mount = get_read_only_mount(Path(target)) if kind is None else None
+            if read_only_mount is not None:
+                # one warning for each mount instead of one failure for each file
+                if read_only_mount not in read_only_mounts:
+                    warn(f"not restoring to '{read_only_mount}': it is a read-only filesystem")
+                    read_only_mounts.add(read_only_mount)
+                debug(f"not restoring to '{target}': '{read_only_mount}' is read-only")
+                continue
+            if kind is None:
+                restore_path(app, rule_name, target, variables)
+            elif kind == "browser":
+                restore_browser(app, rule_name, target, Path(variables["home"]))
+            elif kind == "reg":
+                import_registry(app, rule_name, target)
+            elif kind == "plist":
+                import_plist(app, rule_name, target)
+    set_source_owner(None)
+    save_manifest()
+    print_undo_instructions()
+    print("Done!")
+
+def stat_tree(path: Path):
+    # size and modification time of everything inside, cheap compared to reading the files
+    if not path.exists():
+        return []
+    if not path.is_dir():
+        stat = path.stat()
+        return [(str(path), stat.st_size, stat.st_mtime_ns)]
+    entries = []
+    for root, dirs, files in os.walk(path):
+        dirs.sort()
+        if any(os.path.islink(os.path.join(root, name)) for name in dirs):
+            # what linked folders have inside is not walked, there is no telling if it changed
+            return None
+        for name in sorted(files):
+            if name.endswith("-shm"):
+                # sqlite changes the shared memory index even when only reading the database
+                continue
+            try:
+                stat = os.stat(os.path.join(root, name))
+            except OSError:
+                continue
+            entries.append((os.path.join(root, name), stat.st_size, stat.st_mtime_ns))
+    return entries
+
+def rule_key(app: str, rule_name: str, kind: str, target: str, variables: dict, base: Path):
+    return f"{app} {rule_name} {kind} {target}"
+
+def rule_fingerprint(app: str, rule_name: str, kind: str, target: str, variables: dict, base: Path):
+    # None when the rule can't be checked without running it, like registry keys on Windows
+    import hashlib
+    digest = hashlib.sha256()
+    digest.update(f"{rule_key(app, rule_name, kind, target, variables, base)}\n".encode())
+    paths = []
+    if kind == "browser":
+        for browser, profile in find_browser_profiles(Path(variables["home"])):
+            paths.extend(browser_origin_storage(browser, profile, target))
+    elif kind == "reg" and sys.platform == "win32" or kind == "plist" and sys.platform == "darwin":
+        return None
+    elif kind is None:
+        path = Path(target)
+        if get_bool('general', 'ignore_case') or get_bool(app, 'ignore_case'):
+            path = find_case_insensitive(path) or path
+        paths = list(path.parent.glob(path.name)) if "*" in path.name and path.parent.is_dir() else [path]
+    for path in sorted(paths):
+        entries = stat_tree(path)
+        if entries is None:
+            return None
+        for entry in entries:
+            digest.update(f"{entry}\n".encode())
+    return digest.hexdigest()
+
+def code_fingerprint():
+    # a new version, a changed config or other flags, like --encrypt, can copy differently what didn't change
+    # the output is left out, it is the staging folder in the middle of a run
+    import hashlib
+    import json
+    flags = json.dumps({key: value for key, value in vars(args).items() if key != "output"}, sort_keys=True, default=str)
+    return hashlib.sha256(Path(__file__).read_bytes() + args.config.read_bytes() + flags.encode()).hexdigest()
+
+def sources_fingerprint(rule_fingerprints: list):
+    import hashlib
+    if None in rule_fingerprints:
+        return None
+    return hashlib.sha256("\n".join([code_fingerprint(), *rule_fingerprints]).encode()).hexdigest()
+
+def get_staging_dir(output: Path):
+    # next to the output so publishing is a rename in the same filesystem
+    return output.parent / f".{output.name}.staging"
+
+def use_output(path: Path):
+    # the run works in the staging folder while it is filled and in the output once it is published
+    global META_DIR, BACKUP_DIR, APPS_DIR
+    args.output = path
+    META_DIR = path / "__meta__"
+    BACKUP_DIR = path / "__backup__"
+    APPS_DIR = get_apps_dir()
+    os.chdir(str(path))
+
+# the output while a run fills its staging folder
+published_output = None
+
+def stage_output():
+    # files that are only ever replaced are hard linked, so staging doesn't copy the saves: the saved files and git objects
+    # the meta files and the rest of .git are appended to or written in place, those are copied
+    global published_output
+    from shutil import copy2, copystat, rmtree
+    published = args.output
+    staging = get_staging_dir(published)
+    if staging.exists():
+        debug(f"Removing '{staging}' left by a run that didn't finish")
+        rmtree(staging)
+    for root, dirs, files in os.walk(published):
+        relative = Path(root).relative_to(published)
+        (staging / relative).mkdir()
+        copystat(root, staging / relative)
+        linkable = relative.parts[:1] not in [("__meta__",), (".git",)] or relative.parts[:2] == (".git", "objects")
+        for name in files:
+            if linkable and not os.path.islink(os.path.join(root, name)):
+                try:
+                    os.link(os.path.join(root, name), staging / relative / name)
+                    continue
+                except OSError:
+                    pass
+            copy2(os.path.join(root, name), staging / relative / name, follow_symlinks=False)
+    debug(f"Staging the run in '{staging}'")
+    use_output(staging)
+    published_output = published
+    return published
+
+def publish_output(published: Path):
+    # two renames, whoever watches the output sees the previous run or this one, never half of it
+    global published_output
+    from shutil import rmtree
+    previous = published.parent / f".{published.name}.previous"
+    if previous.exists():
+        rmtree(previous)
+    staging = args.output
+    os.chdir(str(published.parent))
+    os.rename(published, previous)
+    os.rename(staging, published)
+    use_output(published)
+    published_output = None
+    rmtree(previous)
+    debug(f"Published '{staging}' to '{published}'")
+
+def get_metrics_file():
+    # with listen and no textfile the metrics still need a file, the runs are other processes
+    textfile = get_paths('metrics', 'textfile')
+    if len(textfile) > 0:
+        return textfile[0]
+    if get_str('metrics', 'listen') is not None:
+        return get_state_dir() / "metrics.prom"
+    return None
+
+def metric_lines(name: str, kind: str, description: str, samples: list):
+    # samples are (labels, value), in the text format of Prometheus
+    lines = [f"# HELP cloud_savegame_{name} {description}", f"# TYPE cloud_savegame_{name} {kind}"]
+    for labels, value in samples:
+        escaped = {key: str(label).replace("\\", "\\\\").replace('"', '\\"') for key, label in labels.items()}
+        formatted = ",".join(f'{key}="{label}"' for key, label in escaped.items())
+        lines.append(f"cloud_savegame_{name}{{{formatted}}} {value}" if formatted else f"cloud_savegame_{name} {value}")
+    return lines
+
+def write_metrics(status: str):
+    # a textfile for the node_exporter textfile collector, the counters add up across runs in the state folder, so they
+    # are counters for Prometheus even though each run is a new process
+    import json
+    metrics_file = get_metrics_file()
+    if metrics_file is None:
+        return
+    totals_file = get_state_dir() / "metrics.json"
+    totals = json.loads(totals_file.read_text()) if totals_file.is_file() else {}
+    for counter, counts in [("files_copied", app_files_copied), ("bytes_copied", app_bytes_copied), ("warnings", app_warnings)]:
+        for app, count in counts.items():
+            app_totals = totals.setdefault(counter, {})
+            app_totals[app or ""] = app_totals.get(app or "", 0) + count
+    if status == "ok":
+        totals["last_success"] = now().timestamp()
+    totals_file.parent.mkdir(exist_ok=True, parents=True)
+    totals_file.write_text(json.dumps(totals, indent=2, sort_keys=True) + "\n")
+    backed_up = load_meta("coverage.json", {}).get(get_machine_id(), {})
+    from datetime import datetime
+    lines = []
+    lines += metric_lines("last_run_timestamp_seconds", "gauge", "When the last run finished", [({}, now().timestamp())])
+    lines += metric_lines("last_run_success", "gauge", "1 if the last run finished without failing", [({}, int(status == "ok"))])
+    lines += metric_lines("last_success_timestamp_seconds", "gauge", "When the last run that didn't fail finished", [({}, totals.get("last_success", 0))])
+    lines += metric_lines("last_run_duration_seconds", "gauge", "How long the last run took", [({}, run_duration())])
+    lines += metric_lines("app_last_backup_timestamp_seconds", "gauge", "When each app last had something backed up from this machine", [(dict(app=app), datetime.fromisoformat(entry["last_seen"]).timestamp()) for app, entry in sorted(backed_up.items()) if "last_seen" in entry])
+    lines += metric_lines("files_copied_total", "counter", "Files copied of each app", [(dict(app=app), count) for app, count in sorted(totals.get("files_copied", {}).items())])
+    lines += metric_lines("bytes_copied_total", "counter", "Bytes copied of each app", [(dict(app=app), count) for app, count in sorted(totals.get("bytes_copied", {}).items())])
+    lines += metric_lines("warnings_total", "counter", "Warnings of each app, app is empty for the ones outside of apps", [(dict(app=app), count) for app, count in sorted(totals.get("warnings", {}).items())])
+    # written next to it and renamed, the collector never reads half of it
+    metrics_file.parent.mkdir(exist_ok=True, parents=True)
+    partial = metrics_file.with_name(metrics_file.name + ".tmp")
+    partial.write_text("\n".join(lines) + "\n")
+    os.replace(partial, metrics_file)
+
+def serve_metrics():
+    # /metrics for watch and --interval, what the runs wrote last is served as is
+    from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+    from threading import Thread
+    listen = get_str('metrics', 'listen')
+    if listen is None:
+        return
+    host, _, port = listen.rpartition(":")
+    metrics_file = get_metrics_file()
+    class MetricsHandler(BaseHTTPRequestHandler):
+        def do_GET(self):
+            if self.path != "/metrics":
+                self.send_error(404)
+                return
+            body = metrics_file.read_bytes() if metrics_file.is_file() else b""
+            self.send_response(200)
+            self.send_header("Content-Type", "text/plain; version=0.0.4")
+            self.send_header("Content-Length", str(len(body)))
+            self.end_headers()
+            self.wfile.write(body)
+        def log_message(self, *params):
+            pass
+    server = ThreadingHTTPServer((host or "127.0.0.1", int(port)), MetricsHandler)
+    Thread(target=server.serve_forever, daemon=True).start()
+    print(f"Serving metrics on http://{listen}/metrics")
+
+def lock_output():
+    # runs of cron, systemd timers and --interval can overlap when one takes long, only one works on the output at a time
+    import hashlib
+    lock_file = get_state_dir() / f"lock-{hashlib.sha256(str(args.output).encode()).hexdigest()[:16]}"
+    lock_file.parent.mkdir(exist_ok=True, parents=True)
+    lock_output.handle = open(lock_file, 'a+')
+    try:
+        if sys.platform == "win32":
+            import msvcrt
+            msvcrt.locking(lock_output.handle.fileno(), msvcrt.LK_NBLCK, 1)
+        else:
+            import fcntl
+            fcntl.flock(lock_output.handle.fileno(), fcntl.LOCK_EX | fcntl.LOCK_NB)
+    except OSError:
+        return False
+    return True
+
+def lock_instance():
+    # a named mutex on Windows, seen by the runs of every session like the ones of Task Scheduler, a lock file elsewhere
+    if sys.platform == "win32":
+        import ctypes
+        kernel32 = ctypes.windll.kernel32
+        lock_instance.handle = kernel32.CreateMutexW(None, False, "Global\\cloud-savegame")
+        ERROR_ALREADY_EXISTS = 183
+        return lock_instance.handle != 0 and kernel32.GetLastError() != ERROR_ALREADY_EXISTS
+    import fcntl
+    lock_file = get_state_dir() / "instance.lock"
+    lock_file.parent.mkdir(exist_ok=True, parents=True)
+    lock_instance.handle = open(lock_file, 'a+')
+    try:
+        fcntl.flock(lock_instance.handle.fileno(), fcntl.LOCK_EX | fcntl.LOCK_NB)
+    except OSError:
+        return False
+    return True
+
+def keep_awake():
+    # until this process exits, a laptop on battery would otherwise sleep in the middle of a scheduled run
+    if sys.platform == "win32":
+        import ctypes
+        ES_CONTINUOUS = 0x80000000
+        ES_SYSTEM_REQUIRED = 0x00000001
+        ctypes.windll.kernel32.SetThreadExecutionState(ES_CONTINUOUS | ES_SYSTEM_REQUIRED)
+        return
+    if sys.platform == "darwin":
+        command = ["caffeinate", "-i", "-w", str(os.getpid())]
+    else:
+        command = ["systemd-inhibit", "--what=sleep:idle", "--who=cloud-savegame", "--why=Backing up saves", "tail", f"--pid={os.getpid()}", "-f", "/dev/null"]
+    if which(command[0]) is None:
+        warn(f"--keep-awake needs {command[0]}, the system may sleep during the run")
+        return
+    keep_awake.process = subprocess.Popen(command, stdin=subprocess.DEVNULL, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
+
+# shown by Windows as coming from PowerShell, toasts of apps that didn't register an id are dropped
+WINDOWS_TOAST_APP_ID = "{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\\WindowsPowerShell\\v1.0\\powershell.exe"
+WINDOWS_TOAST_SCRIPT = """
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode($env:CLOUD_SAVEGAME_TITLE)) > $null
+$text.Item(1).AppendChild($template.CreateTextNode($env:CLOUD_SAVEGAME_MESSAGE)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($env:CLOUD_SAVEGAME_APP_ID).Show([Windows.UI.Notifications.ToastNotification]::new($template))
+"""
+
+def desktop_notify(title: str, message: str):
+    # the text goes in environment variables so nothing has to be quoted for the shell of each platform
+    if not args.notify:
+        return
+    if sys.platform == "win32":
+        command = ["powershell", "-NoProfile", "-NonInteractive", "-Command", WINDOWS_TOAST_SCRIPT]
+    elif sys.platform == "darwin":
+        command = ["osascript", "-e", 'display notification (system attribute "CLOUD_SAVEGAME_MESSAGE") with title (system attribute "CLOUD_SAVEGAME_TITLE")']
+    else:
+        command = ["notify-send", "--app-name=cloud-savegame", title, message]
+    if which(command[0]) is None:
+        debug(f"Not notifying: {command[0]} not found")
+        return
+    environment = dict(os.environ, CLOUD_SAVEGAME_TITLE=title, CLOUD_SAVEGAME_MESSAGE=message, CLOUD_SAVEGAME_APP_ID=WINDOWS_TOAST_APP_ID)
+    try:
+        subprocess.run(command, env=environment, stdin=subprocess.DEVNULL, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL, timeout=10)
+    except subprocess.TimeoutExpired:
+        debug("Not notifying: the notification took too long")
+
+def notify_run():
+    # runs where nothing was copied and nothing went wrong are not worth a notification, with --interval they would come every time
+    updated = sorted(app for app, count in app_files_copied.items() if app is not None and count > 0)
+    if len(updated) == 0 and run_stats["warnings"] == 0 and run_stats["conflicts"] == 0:
+        return
+    lines = [f"{len(updated)} apps updated: {', '.join(updated)}" if len(updated) > 0 else "no apps updated"]
+    if run_stats["warnings"] > 0:
+        lines.append(f"{run_stats['warnings']} warnings")
+    if run_stats["conflicts"] > 0:
+        lines.append(f"{run_stats['conflicts']} conflicts with other machines, see {CONFLICT_LOG} in {META_DIR.name}")
+    send_notification(f"Backup of {get_hostname()} done", "\n".join(lines + run_news), status="ok", apps=updated)
+
+def post_json(url: str, data: dict, headers={}):
+    import json
+    from urllib.request import Request, urlopen
+    request = Request(url, data=json.dumps(data).encode(), headers={"Content-Type": "application/json", **headers})
+    urlopen(request, timeout=10).close()
+
+def notify_webhook(title: str, message: str, summary: dict):
+    url = get_str('notify', 'webhook_url')
+    assert url is not None, "the webhook notifier needs webhook_url in [notify]"
+    post_json(url, dict(title=title, message=message, **summary))
+
+def notify_gotify(title: str, message: str, summary: dict):
+    url = get_str('notify', 'gotify_url')
+    token = get_str('notify', 'gotify_token')
+    assert url is not None and token is not None, "the gotify notifier needs gotify_url and gotify_token in [notify]"
+    # failed runs come with a higher priority, so phones make noise for them
+    priority = int(get_str('notify', 'gotify_priority') or 5) + (3 if summary["status"] == "failed" else 0)
+    post_json(url.rstrip("/") + "/message", dict(title=title, message=message, priority=priority), headers={"X-Gotify-Key": token})
+
+def notify_telegram(title: str, message: str, summary: dict):
+    token = get_str('notify', 'telegram_token')
+    chat_id = get_str('notify', 'telegram_chat_id')
+    assert token is not None and chat_id is not None, "the telegram notifier needs telegram_token and telegram_chat_id in [notify]"
+    post_json(f"https://api.telegram.org/bot{token}/sendMessage", dict(chat_id=chat_id, text=f"{title}\n{message}"))
+
+notifiers = dict(webhook=notify_webhook, gotify=notify_gotify, telegram=notify_telegram)
+
+def register_notifier(name: str, notifier):
+    # for plugins, notifier(title, message, summary) sends it, summary has the status, apps, news and counters of the run
+    notifiers[name] = notifier
+
+def send_notification(title: str, message: str, status: str, apps=[]):
+    # on the desktop with --notify and to the services of [notify], for headless machines
+    desktop_notify(title, message)
+    summary = dict(status=status, hostname=get_hostname(), machine_id=get_machine_id(), apps=apps, news=run_news, **run_stats)
+    for service in get_list('notify', 'services') or []:
+        if service not in notifiers:
+            # an assert here would hide why a failed run failed
+            warn(f"unknown notifier '{service}', available: {', '.join(notifiers)}")
+            continue
+        try:
+            notifiers[service](title, message, summary)
+        except Exception as e:
+            # a half configured or broken notifier, even of a plugin, can't be what fails the run
+            warn(f"notifying with {service} failed: {e or type(e).__name__}")
+
+def run_on_interval():
+    # each backup runs in a new process so nothing of a run leaks to the next one
+    import random
+    from time import sleep
+    interval = parse_duration(args.interval)
+    jitter = get_duration('schedule', 'jitter') or 0
+    argv = []
+    skip_next = False
+    for arg in sys.argv[1:]:
+        if skip_next:
+            skip_next = False
+        elif arg == "--interval":
+            skip_next = True
+        elif not arg.startswith("--interval="):
+            argv.append(arg)
+    environment = dict(os.environ, CLOUD_SAVEGAME_SCHEDULED="1")
+    serve_metrics()
+    sd_notify("READY=1")
+    while True:
+        result = subprocess.run([sys.executable, str(Path(__file__).resolve()), *argv], env=environment, cwd=launch_dir)
+        if result.returncode != 0:
+            warn(f"the backup failed with exit code {result.returncode}")
+        # the jitter spreads the runs of many machines pushing to the same remote
+        wait = interval + random.uniform(0, jitter)
+        info(f"Next backup in {format_duration(wait)}")
+        outcome = "ok" if result.returncode == 0 else f"failed with exit code {result.returncode}"
+        sd_notify(f"STATUS=Last backup {outcome}, next in {format_duration(wait)}")
+        sleep(wait)
+
+HOOK_TIMEOUT = "5m"
+# hooks that ran in this run, post_run also runs when the run fails after pre_run
+hooks_ran = set()
+
+def run_hook(name: str, **context):
+    # shell commands of [hooks], like stopping Syncthing or mounting a drive, the context goes in CLOUD_SAVEGAME_* variables
+    # False when the command failed
+    command = get_str('hooks', name)
+    if command is None:
+        return True
+    hooks_ran.add(name)
+    environment = dict(os.environ, CLOUD_SAVEGAME_HOOK=name, CLOUD_SAVEGAME_OUTPUT=str(args.output), CLOUD_SAVEGAME_HOSTNAME=get_hostname())
+    environment.update({f"CLOUD_SAVEGAME_{key.upper()}": str(value) for key, value in context.items()})
+    debug(f"Running the {name} hook: {command}")
+    try:
+        result = subprocess.run(command, shell=True, env=environment, cwd=launch_dir, capture_output=True, text=True, timeout=get_duration('hooks', 'timeout') or parse_duration(HOOK_TIMEOUT))
+    except subprocess.TimeoutExpired:
+        warn(f"the {name} hook took too long and was stopped")
+        return False
+    if result.stdout.strip() != "":
+        debug(f"the {name} hook printed: {result.stdout.strip()}")
+    if result.returncode != 0:
+        warn(f"the {name} hook failed with exit code {result.returncode}: {result.stderr.strip()}")
+        return False
+    return True
+
+def list_processes():
+    # lowercase names of the running programs, without .exe so Windows games under Wine match too
+    names = set()
+    if sys.platform == "win32":
+        import csv
+        output = subprocess.run(["tasklist", "/fo", "csv", "/nh"], capture_output=True, text=True).stdout
+        names.update(row[0] for row in csv.reader(output.splitlines()) if len(row) > 0)
+    elif Path("/proc").is_dir():
+        for process in Path("/proc").iterdir():
+            if not process.name.isdigit():
+                continue
+            try:
+                names.add((process / "comm").read_text().strip())
+                # comm is cut at 15 characters and is the name of the Wine loader for Windows games
+                argv0 = (process / "cmdline").read_bytes().split(b"\0")[0].decode(errors='replace')
+                names.add(re.split(r'[\\/]', argv0)[-1])
+            except OSError:
+                continue
+    else:
+        output = subprocess.run(["ps", "-axo", "comm="], capture_output=True, text=True).stdout
+        names.update(Path(line.strip()).name for line in output.splitlines())
+    return set(re.sub(r'\.exe$', '', name.lower()) for name in names if name != "")
+
+def watch():
+    # a snapshot right after the game exits has the save it just wrote, a timer can catch it in the middle of a session
+    from time import sleep
+    for app in args.apps:
+        assert app in apps, f"unknown app '{app}'"
+        assert get_list(app, 'processes') is not None, f"set processes in the [{app}] section to watch it"
+    watched = {app: set(re.sub(r'\.exe$', '', name.lower()) for name in get_list(app, 'processes') or []) for app in args.apps or sorted(apps)}
+    watched = {app: processes for app, processes in watched.items() if len(processes) > 0}
+    assert len(watched) > 0, "no app to watch, set processes in the section of the apps"
+    every = parse_duration(args.every)
+    global_args = sys.argv[1:sys.argv.index("watch")]
+    environment = dict(os.environ, CLOUD_SAVEGAME_SCHEDULED="1")
+    serve_metrics()
+    info(f"Watching {', '.join(sorted(watched))}")
+    sd_notify("READY=1", f"STATUS=Watching {len(watched)} apps")
+    running = set()
+    while True:
+        names = list_processes()
+        for app, processes in watched.items():
+            if len(processes & names) > 0:
+                if app not in running:
+                    debug(f"{app} started")
+                running.add(app)
+            elif app in running:
+                running.discard(app)
+                info(f"{app} exited, backing it up")
+                sd_notify(f"STATUS=Backing up {app}")
+                result = subprocess.run([sys.executable, str(Path(__file__).resolve()), *global_args, "--only-apps", app], env=environment, cwd=launch_dir)
+                if result.returncode != 0:
+                    warn(f"the backup of {app} failed with exit code {result.returncode}")
+                sd_notify(f"STATUS=Watching {len(watched)} apps, last backed up {app}")
+        sleep(every)
+
+def backup():
+    if args.single_instance and not lock_instance():
+        info("Another backup is running on this machine, not running")
+        sd_notify("STATUS=Another backup is running on this machine")
+        return
+    if not lock_output():
+        info("Another run is working on this output, not running")
+        sd_notify("STATUS=Another run is working on this output")
+        return
+    sd_notify("READY=1", "STATUS=Looking for saves")
+    if args.keep_awake:
+        keep_awake()
+    resolved_rules = list(resolve_rules())
+    # an idle machine run every hour shouldn't touch git when nothing changed since the previous run
+    rule_fingerprints = {rule_key(*resolved_rule): rule_fingerprint(*resolved_rule) for resolved_rule in resolved_rules}
+    fingerprint = sources_fingerprint(list(rule_fingerprints.values()))
+    previous_fingerprint = load_meta("fingerprints.json", {}).get(get_machine_id())
+    pending = load_meta("pending_apps.json", {}).get(get_machine_id(), [])
+    if fingerprint is not None and fingerprint == previous_fingerprint and len(pending) == 0:
+        info("Nothing changed since the previous run")
+        sd_notify("STATUS=Nothing changed since the previous run")
+        write_metrics("ok")
+        return
+
+    if not run_hook("pre_run"):
+        info("Not running: the pre_run hook failed")
+        return
+    remove_temp_files(args.output)
+    published = stage_output() if get_bool('output', 'staging') else None
+    prepare_git_repo()
+    register_machine()
+
+    app_order = {app: i for i, app in enumerate(order_apps(set(rule[0] for rule in resolved_rules)))}
+    # the sort is stable so the rules of an app keep the order they were found
+    resolved_rules.sort(key=lambda rule: app_order[rule[0]])
+    progress["rules"] = len(resolved_rules)
+    # rules whose files are as they were when the previous run copied them without trouble are not walked again, with
+    # many rules in huge libraries that is most of them
+    previous_rules = load_meta("rule_fingerprints.json", {}).get(get_machine_id(), {})
+    previous_rules = previous_rules.get("rules", {}) if previous_rules.get("code") == code_fingerprint() else {}
+    done_rules = {}
+    not_due = get_not_due_apps(app_order)
+    if len(not_due) > 0:
+        debug(f"Not backing up {', '.join(sorted(not_due))}: backed up more recently than their schedule")
+    for i, resolved_rule in enumerate(resolved_rules):
+        app = resolved_rule[0]
+        last_of_app = i + 1 == len(resolved_rules) or resolved_rules[i + 1][0] != app
+        if i == 0 or resolved_rules[i - 1][0] != app:
+            sd_notify(f"STATUS=Backing up {app} ({app_order[app] + 1}/{len(app_order)}), {run_summary()}")
+            progress["app"] = app
+            show_progress(force=True)
+            if app not in not_due and not run_hook(f"pre_app_{app}", app=app):
+                # like a game that must be closed first, it is tried again in the next run
+                not_due.add(app)
+        key = rule_key(*resolved_rule)
+        progress["rules_done"] = i + 1
+        if app in not_due:
+            continue
+        if rule_fingerprints[key] is not None and previous_rules.get(key) == rule_fingerprints[key] and app not in pending and (APPS_DIR / app / resolved_rule[1]).exists():
+            debug(f"Not looking at '{resolved_rule[3]}' of {app}: nothing changed since the previous run")
+            done_rules[key] = rule_fingerprints[key]
+            ingested_apps.add(app)
+            continue
+        warnings = run_stats["warnings"]
+        ingest_resolved(*resolved_rule)
+        if run_stats["warnings"] == warnings and app not in skipped_apps | blocked_apps and rule_target_exists(*resolved_rule[2:5]):
+            done_rules[key] = rule_fingerprints[key]
+        if args.git_commit_granularity == "app" and last_of_app:
+            git_commit_if_dirty(f"app={app}")
+        if last_of_app:
+            run_hook(f"post_app_{app}", app=app, files_changed=app_files_copied.get(app, 0))
+    clear_progress()
+    progress["app"] = None
+    for app in sorted(ingested_apps):
+        emit("app_done", app=app)
+
+    save_manifest()
+    remove_orphan_blobs()
+    save_misses()
+    save_coverage()
+    save_sessions()
+    save_steam_accounts()
+    if get_str('general', 'backup_retention') is not None:
+        prune_backups(get_str('general', 'backup_retention'))
+    save_pending_apps()
+    save_app_activity()
+    record_last_run()
+    record_run_history("ok" if len(skipped_apps) == 0 else "timeout")
+    fingerprints = load_meta("fingerprints.json", {})
+    # the apps that were left out would look unchanged in the next run
+    fingerprints[get_machine_id()] = fingerprint if len(skipped_apps) == 0 and len(not_due) == 0 else None
+    save_meta("fingerprints.json", fingerprints)
+    all_rule_fingerprints = load_meta("rule_fingerprints.json", {})
+    all_rule_fingerprints[get_machine_id()] = dict(code=code_fingerprint(), rules=done_rules)
+    save_meta("rule_fingerprints.json", all_rule_fingerprints)
+    pushing = args.git and git_has_remote()
+    if args.git and not pushing:
+        debug("Not pushing: the output repo has no remote")
+    uploading = (pushing or get_str('remote', 'storage') is not None) and check_transfer_quota()
+    if args.git:
+        # with one commit per run this is the commit with everything, the quota only holds back the upload
+        git_commit_if_dirty("run metadata" if args.git_commit_granularity != "run" else f"run apps={','.join(sorted(ingested_apps))}")
+    if published is not None:
+        publish_output(published)
+    uploaded = False
+    if pushing and uploading:
+        if git("push", always_show=True, check=False) == 0:
+            uploaded = True
+        else:
+            warn("pushing the output repo failed, the commits are pushed by the next run")
+    if uploading:
+        uploaded = mirror_output() or uploaded
+    if uploaded:
+        account_transfer()
+    send_telemetry()
+    run_hook("post_run", status="ok" if len(skipped_apps) == 0 else "timeout", files_changed=run_stats["files_copied"], apps=",".join(sorted(app for app in app_files_copied if app is not None)))
+    sd_notify(f"STATUS=Done, {run_summary()}")
+    write_metrics("ok")
+    notify_run()
+    info(f"Done! {run_summary()}", status="ok", duration_seconds=run_duration(), **run_stats)
 
+load_plugins()
 
-git("push", always_show=True)
-print("Done!")
+if args.command == "show-diff":
+    show_diff()
+elif args.command == "history":
+    history()
+elif args.command == "stats":
+    stats()
+elif args.command == "sessions":
+    sessions()
+elif args.command == "activity":
+    activity()
+elif args.command == "migrate" and args.migrate_command == "export":
+    migrate_export()
+elif args.command == "migrate" and args.migrate_command == "import":
+    migrate_import()
+elif args.command == "migrate" and args.migrate_command == "legacy":
+    migrate_legacy()
+elif args.command == "coverage":
+    coverage()
+elif args.command == "status":
+    status()
+elif args.command == "list-apps":
+    list_apps()
+elif args.command == "verify":
+    verify()
+elif args.command == "analyze":
+    analyze()
+elif args.command == "watch":
+    try:
+        watch()
+    except KeyboardInterrupt:
+        print("Stopped")
+elif args.command == "tui":
+    tui()
+elif args.command == "schema":
+    schema()
+elif args.command == "config" and args.config_command == "get":
+    config_get()
+elif args.command == "config" and args.config_command in ("set", "unset"):
+    config_edit(args.config_command, args.key, getattr(args, 'value', None))
+elif args.command == "gog" and args.gog_command == "import":
+    gog_import()
+elif args.command == "url" and args.url_command == "register":
+    url_register()
+elif args.command == "url" and args.url_command == "open":
+    url_open()
+elif args.command == "prune":
+    prune()
+elif args.command == "restore":
+    if args.at is not None:
+        restore_at()
+    else:
+        restore()
+elif args.command == "merge":
+    merge()
+elif args.command == "telemetry":
+    telemetry()
+elif args.interval is not None and os.environ.get("CLOUD_SAVEGAME_SCHEDULED") is None:
+    try:
+        run_on_interval()
+    except KeyboardInterrupt:
+        print("Stopped")
+else:
+    try:
+        backup()
+    except BaseException as e:
+        if isinstance(e, SystemExit) and e.code in (None, 0):
+            raise
+        if published_output is not None:
+            # the staging folder is removed by the next run, the history of this one goes to the output
+            use_output(published_output)
+        record_run_history("interrupted" if isinstance(e, KeyboardInterrupt) else "failed")
+        if "pre_run" in hooks_ran and "post_run" not in hooks_ran:
+            # whatever pre_run stopped or mounted has to be brought back
+            run_hook("post_run", status="failed", files_changed=run_stats["files_copied"], apps=",".join(sorted(app for app in app_files_copied if app is not None)))
+        sd_notify(f"STATUS=Failed: {e}, {run_summary()}")
+        write_metrics("failed")
+        if not isinstance(e, KeyboardInterrupt):
+            send_notification(f"Backup of {get_hostname()} failed", "\n".join([str(e) or type(e).__name__] + run_news), status="failed")
+        if args.log_format == "json" and not isinstance(e, KeyboardInterrupt):
+            write_log_record("error", str(e) or type(e).__name__, error=type(e).__name__, status="failed", **run_stats)
+        if isinstance(e, (GitError, ConflictError, OutputError)):
+            print(f"Error: {e}", file=sys.stderr)
+            sys.exit(1)
+        raise
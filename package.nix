@@ -2,7 +2,7 @@
 stdenvNoCC.mkDerivation {
   name = "cloud-savegame";
 
-  buildInputs = [ python3 ];
+  buildInputs = [ (python3.withPackages (ps: [ ps.pyyaml ])) ];
 
   dontUnpack = true;
 
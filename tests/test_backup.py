@@ -0,0 +1,676 @@
+#!/usr/bin/env python3
+# behavior tests, each one runs backup.py in a sandbox with its own rules, homes, state and output
+# run with python3 -m unittest discover tests
+
+import hashlib
+import json
+import os
+import shutil
+import subprocess
+import sys
+import tempfile
+import time
+import unittest
+from pathlib import Path
+
+REPO = Path(__file__).resolve().parents[1]
+
+
+class Sandbox:
+    def __init__(self, rules: dict):
+        self.dir = Path(tempfile.mkdtemp(prefix="cloud-savegame-test-"))
+        shutil.copy(REPO / "backup.py", self.dir)
+        (self.dir / "rules").mkdir()
+        for app, lines in rules.items():
+            (self.dir / "rules" / f"{app}.txt").write_text("\n".join(lines) + "\n")
+        # nothing is searched outside of the sandbox
+        (self.dir / "search").mkdir()
+        self.output = self.dir / "out"
+
+    def home(self, name: str):
+        home = self.dir / "homes" / name
+        home.mkdir(parents=True, exist_ok=True)
+        return home
+
+    def write(self, path: Path, text: str):
+        # a second later, so changes are seen by the modification times too
+        path.parent.mkdir(parents=True, exist_ok=True)
+        if path.exists():
+            time.sleep(1.1)
+        path.write_text(text)
+
+    def run(self, machine: str, *args, home: Path = None, general: str = "", config: str = "", path: str = None, check=True):
+        home = home or self.home(machine)
+        config_file = self.dir / f"{machine}.cfg"
+        config_file.write_text("\n".join([
+            "[general]",
+            f"machine_id={machine}",
+            f"hostname={machine}",
+            general,
+            "[search]",
+            f"paths={self.dir / 'search'}",
+            f"extra_homes={home}",
+            config,
+        ]) + "\n")
+        env = dict(
+            os.environ,
+            HOME=str(home),
+            XDG_STATE_HOME=str(self.dir / "state" / machine),
+            GIT_AUTHOR_NAME="test", GIT_AUTHOR_EMAIL="test@localhost",
+            GIT_COMMITTER_NAME="test", GIT_COMMITTER_EMAIL="test@localhost",
+        )
+        if path is not None:
+            env["PATH"] = path
+        result = subprocess.run([sys.executable, str(self.dir / "backup.py"), "-c", str(config_file), "-o", str(self.output), *args], capture_output=True, text=True, env=env, stdin=subprocess.DEVNULL)
+        if check and result.returncode != 0:
+            raise AssertionError(f"backup.py {' '.join(args)} exited with {result.returncode}:\n{result.stdout}\n{result.stderr}")
+        return result
+
+    def forget_fingerprints(self):
+        # runs where the sources of the machine didn't change stop early, the tests want them to look at every file
+        for name in ["fingerprints.json", "rule_fingerprints.json"]:
+            (self.output / "__meta__" / name).unlink(missing_ok=True)
+
+    def manifest(self):
+        return json.loads((self.output / "__meta__" / "manifest.json").read_text())
+
+    def cleanup(self):
+        shutil.rmtree(self.dir, ignore_errors=True)
+
+
+class SandboxTest(unittest.TestCase):
+    rules = {}
+
+    def setUp(self):
+        self.sandbox = Sandbox(self.rules)
+        self.addCleanup(self.sandbox.cleanup)
+
+
+class ConflictTest(SandboxTest):
+    rules = {"game": ["saves $home/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        self.slots = {}
+        for machine in ["a", "b"]:
+            self.slots[machine] = self.sandbox.home(machine) / "saves" / "slot1"
+            self.sandbox.write(self.slots[machine], "v1")
+            self.run_machine(machine)
+
+    def run_machine(self, machine: str, *args, **kwargs):
+        self.sandbox.forget_fingerprints()
+        return self.sandbox.run(machine, *args, general="change_detection=sha256", **kwargs)
+
+    def test_change_of_one_machine_is_not_a_conflict(self):
+        self.sandbox.write(self.slots["a"], "v2")
+        self.run_machine("a")
+        for _ in range(2):
+            result = self.run_machine("b", "--on-conflict", "keep-both")
+            self.assertNotIn("both changed", result.stdout)
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1").read_text(), "v2")
+        self.assertEqual(list((self.sandbox.output / "game" / "saves").glob("*.conflict-*")), [])
+
+    def test_change_of_both_machines_is_a_conflict_once(self):
+        self.sandbox.write(self.slots["a"], "v2")
+        self.run_machine("a")
+        self.sandbox.write(self.slots["b"], "v3")
+        result = self.run_machine("b", "--on-conflict", "keep-both")
+        self.assertIn("a and b both changed 'game/saves/slot1'", result.stdout)
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1.conflict-b").read_text(), "v3")
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1").read_text(), "v2")
+        result = self.run_machine("b", "--on-conflict", "keep-both")
+        self.assertNotIn("both changed", result.stdout)
+
+    def test_abort_stops_only_on_real_conflicts(self):
+        self.sandbox.write(self.slots["a"], "v2")
+        self.run_machine("a")
+        self.run_machine("b", "--on-conflict", "abort")
+        self.sandbox.write(self.slots["b"], "v3")
+        self.sandbox.write(self.slots["a"], "v4")
+        self.run_machine("a")
+        result = self.run_machine("b", "--on-conflict", "abort", check=False)
+        self.assertNotEqual(result.returncode, 0)
+
+    def test_restore_leaves_out_conflict_copies(self):
+        self.sandbox.write(self.slots["a"], "v2")
+        self.run_machine("a")
+        self.sandbox.write(self.slots["b"], "v3")
+        self.run_machine("b", "--on-conflict", "keep-both")
+        self.slots["a"].unlink()
+        self.run_machine("a", "restore", "game")
+        self.assertEqual(self.slots["a"].read_text(), "v2")
+        self.assertEqual(list(self.slots["a"].parent.glob("*.conflict-*")), [])
+
+
+class GitTest(SandboxTest):
+    rules = {"game": ["saves $home/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v1")
+        self.sandbox.run("a", "-g")
+
+    def git(self, *params):
+        return subprocess.run(["git", "-C", str(self.sandbox.output), *params], capture_output=True, text=True, check=True).stdout
+
+    def commits(self):
+        return self.git("log", "--format=%s").splitlines()
+
+    def test_unreachable_remote_is_a_warning(self):
+        self.git("remote", "add", "origin", str(self.sandbox.dir / "missing.git"))
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v2")
+        result = self.sandbox.run("a", "-g")
+        self.assertIn("Warning: pulling the output repo failed", result.stdout)
+        self.assertIn("Warning: pushing the output repo failed", result.stdout)
+        self.assertEqual(self.git("show", "HEAD:game/saves/slot1"), "v2")
+
+    def test_remote_without_upstream_is_a_warning(self):
+        remote = self.sandbox.dir / "remote.git"
+        subprocess.run(["git", "init", "--bare", "--quiet", str(remote)], check=True)
+        self.git("remote", "add", "origin", str(remote))
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v2")
+        result = self.sandbox.run("a", "-g")
+        self.assertIn("Warning: pulling the output repo failed", result.stdout)
+        self.assertEqual(self.git("show", "HEAD:game/saves/slot1"), "v2")
+
+    def test_pull_brings_the_changes_of_the_remote(self):
+        remote = self.sandbox.dir / "remote.git"
+        subprocess.run(["git", "clone", "--bare", "--quiet", str(self.sandbox.output), str(remote)], check=True)
+        self.git("remote", "add", "origin", str(remote))
+        self.git("fetch", "--quiet", "origin")
+        self.git("branch", "--set-upstream-to", "origin/master")
+        clone = self.sandbox.dir / "clone"
+        subprocess.run(["git", "clone", "--quiet", str(remote), str(clone)], check=True)
+        (clone / "other").write_text("from another machine")
+        subprocess.run(["git", "-C", str(clone), "add", "other"], check=True)
+        subprocess.run(["git", "-C", str(clone), "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--quiet", "-m", "other"], check=True)
+        subprocess.run(["git", "-C", str(clone), "push", "--quiet"], check=True)
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v2")
+        result = self.sandbox.run("a", "-g")
+        self.assertNotIn("Warning", result.stdout)
+        self.assertEqual((self.sandbox.output / "other").read_text(), "from another machine")
+        self.assertEqual(subprocess.run(["git", "--git-dir", str(remote), "show", "master:game/saves/slot1"], capture_output=True, text=True).stdout, "v2")
+
+    def test_dirty_repo_is_committed_as_is(self):
+        (self.sandbox.output / "notes.txt").write_text("left behind")
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v2")
+        self.sandbox.run("a", "-g")
+        self.assertIn("dirty repo state", self.commits())
+        self.assertEqual(self.git("status", "--porcelain"), "")
+
+    def test_dirty_repo_fails_with_fail(self):
+        (self.sandbox.output / "notes.txt").write_text("left behind")
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v2")
+        result = self.sandbox.run("a", "-g", config="[git]\ndirty_policy=fail", check=False)
+        self.assertNotEqual(result.returncode, 0)
+        self.assertIn("notes.txt", result.stderr)
+        self.assertTrue((self.sandbox.output / "notes.txt").exists())
+
+    def test_untracked_meta_is_discarded(self):
+        (self.sandbox.output / "__meta__" / "leftover.json").write_text("{}")
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v2")
+        self.sandbox.run("a", "-g", config="[git]\ndirty_policy=discard_untracked_meta_only")
+        self.assertFalse((self.sandbox.output / "__meta__" / "leftover.json").exists())
+        self.assertNotIn("dirty repo state", self.commits())
+
+    def test_other_changes_are_not_discarded(self):
+        (self.sandbox.output / "notes.txt").write_text("left behind")
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v2")
+        result = self.sandbox.run("a", "-g", config="[git]\ndirty_policy=discard_untracked_meta_only", check=False)
+        self.assertNotEqual(result.returncode, 0)
+        self.assertTrue((self.sandbox.output / "notes.txt").exists())
+
+
+class QuotaTest(SandboxTest):
+    rules = {"game": ["saves $home/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        self.slot = self.sandbox.home("a") / "saves" / "slot1"
+        self.sandbox.write(self.slot, "v1")
+        self.sandbox.run("a", "-g")
+        self.remote = self.sandbox.dir / "remote.git"
+        subprocess.run(["git", "clone", "--bare", "--quiet", str(self.sandbox.output), str(self.remote)], check=True)
+        for params in [["remote", "add", "origin", str(self.remote)], ["fetch", "--quiet", "origin"], ["branch", "--set-upstream-to", "origin/master"]]:
+            subprocess.run(["git", "-C", str(self.sandbox.output), *params], capture_output=True, check=True)
+
+    def pushed(self):
+        return subprocess.run(["git", "--git-dir", str(self.remote), "show", "master:game/saves/slot1"], capture_output=True, text=True).stdout
+
+    def transfer(self):
+        return json.loads((self.sandbox.output / "__meta__" / "transfer.json").read_text())
+
+    def test_held_back_run_goes_with_the_next_push(self):
+        self.sandbox.write(self.slot, "x" * 2000)
+        result = self.sandbox.run("a", "-g", config="[remote]\nmax_upload_per_run=1K")
+        self.assertIn("not pushing: this run copied", result.stdout)
+        self.assertEqual(self.pushed(), "v1")
+        self.assertEqual(self.transfer()["pending"], 2000)
+        self.sandbox.write(self.slot, "v3")
+        result = self.sandbox.run("a", "-g", config="[remote]\nmax_upload_per_run=1K")
+        self.assertNotIn("not pushing", result.stdout)
+        self.assertEqual(self.pushed(), "v3")
+        self.assertNotIn("pending", self.transfer())
+        self.assertEqual(sum(self.transfer().values()), 2002)
+
+    def test_monthly_quota_counts_what_is_waiting(self):
+        self.sandbox.write(self.slot, "x" * 800)
+        self.sandbox.run("a", "-g", config="[remote]\nmax_upload_per_run=500")
+        self.sandbox.write(self.slot, "x" * 400)
+        result = self.sandbox.run("a", "-g", config="[remote]\nmonthly_quota=1K")
+        self.assertIn("not pushing: 1.2KB are waiting to be uploaded", result.stdout)
+        self.assertEqual(self.pushed(), "v1")
+
+
+class MigrateTest(SandboxTest):
+    rules = {"game": ["saves $installdir/saves"]}
+
+    def test_import_changes_the_old_home_only_in_the_config(self):
+        home_a, home_b = self.sandbox.home("a"), self.sandbox.home("b")
+        sibling = self.sandbox.home("a2")
+        plugin = home_a / "plugins" / "plugin.py"
+        plugin.parent.mkdir(parents=True)
+        plugin.write_text(f"# written for {home_a}\n")
+        bundle = self.sandbox.dir / "bundle.tar.gz"
+        self.sandbox.run("a", "migrate", "export", str(bundle), general=f"plugins={plugin}", config=f"[game]\ninstalldir={home_a}/games/game,{sibling}/games/game")
+        self.sandbox.run("b", "migrate", "import", str(bundle), "-y")
+        imported = (self.sandbox.dir / "b.cfg").read_text()
+        self.assertIn(f"extra_homes={home_b}\n", imported)
+        self.assertIn(f"plugins={home_b}/plugins/plugin.py\n", imported)
+        self.assertIn(f"installdir={home_b}/games/game,{sibling}/games/game\n", imported)
+        self.assertEqual((home_b / "plugins" / "plugin.py").read_text(), f"# written for {home_a}\n")
+
+
+class StagingTest(SandboxTest):
+    rules = {"game": ["saves $home/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        self.slots = {machine: self.sandbox.home(machine) / "saves" / "slot1" for machine in ["a", "b"]}
+
+    def run_machine(self, machine: str, *args, **kwargs):
+        self.sandbox.forget_fingerprints()
+        return self.sandbox.run(machine, *args, general="change_detection=sha256", config="[output]\nstaging=1", **kwargs)
+
+    def runs(self):
+        return [json.loads(line) for line in (self.sandbox.output / "__meta__" / "runs.jsonl").read_text().splitlines()]
+
+    def test_run_is_published(self):
+        self.sandbox.write(self.slots["a"], "v1")
+        self.run_machine("a")
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1").read_text(), "v1")
+        self.assertEqual(sorted(path.name for path in self.sandbox.output.parent.iterdir() if path.name.startswith(".out")), [])
+        self.assertEqual([run["status"] for run in self.runs()], ["ok"])
+
+    def test_failed_run_is_in_the_history(self):
+        for machine in ["a", "b"]:
+            self.sandbox.write(self.slots[machine], "v1")
+            self.run_machine(machine)
+        self.sandbox.write(self.slots["a"], "v2")
+        self.run_machine("a")
+        self.sandbox.write(self.slots["b"], "v3")
+        result = self.run_machine("b", "--on-conflict", "abort", check=False)
+        self.assertNotEqual(result.returncode, 0)
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1").read_text(), "v2")
+        self.assertEqual([(run["hostname"], run["status"]) for run in self.runs()], [("a", "ok"), ("b", "ok"), ("a", "ok"), ("b", "failed")])
+        self.sandbox.write(self.slots["b"], "v2")
+        self.run_machine("b")
+        self.assertEqual([run["status"] for run in self.runs()][-2:], ["failed", "ok"])
+
+
+class NativeGitTest(SandboxTest):
+    rules = {"game": ["saves $home/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        self.slot = self.sandbox.home("a") / "saves" / "slot1"
+        # a PATH without git
+        self.nogit = self.sandbox.dir / "nogit"
+        self.nogit.mkdir()
+
+    def run_machine(self, text: str, native=True):
+        self.sandbox.write(self.slot, text)
+        return self.sandbox.run("a", "-g", path=str(self.nogit) if native else None)
+
+    def git(self, *params):
+        return subprocess.run(["git", "-C", str(self.sandbox.output), *params], capture_output=True, text=True, check=True).stdout
+
+    def test_snapshots_are_made_without_git(self):
+        self.run_machine("v1")
+        self.run_machine("v2")
+        self.assertEqual(len(self.git("log", "--format=%s").splitlines()), 2)
+        self.assertEqual(self.git("show", "HEAD:game/saves/slot1"), "v2")
+        self.assertEqual(self.git("show", "HEAD~1:game/saves/slot1"), "v1")
+        self.assertEqual(self.git("status", "--porcelain", "--untracked-files=all"), "")
+        self.git("fsck", "--strict")
+
+    def test_git_and_native_snapshots_take_turns(self):
+        self.run_machine("v1")
+        self.run_machine("v2", native=False)
+        self.run_machine("v3")
+        self.assertEqual([self.git("show", f"HEAD~{i}:game/saves/slot1") for i in range(3)], ["v3", "v2", "v1"])
+        self.assertEqual(self.git("status", "--porcelain", "--untracked-files=all"), "")
+        self.git("fsck", "--strict")
+
+    def test_dirty_repo_is_committed_as_is(self):
+        self.run_machine("v1")
+        (self.sandbox.output / "notes.txt").write_text("left behind")
+        self.run_machine("v2")
+        self.assertIn("dirty repo state", self.git("log", "--format=%s"))
+        self.assertEqual(self.git("show", "HEAD:notes.txt"), "left behind")
+
+    def test_remote_needs_git(self):
+        self.run_machine("v1")
+        self.git("remote", "add", "origin", str(self.sandbox.dir / "remote.git"))
+        result = self.run_machine("v2")
+        self.assertIn("pulling and pushing need git installed", result.stdout)
+        self.assertEqual(self.git("show", "HEAD:game/saves/slot1"), "v2")
+
+
+class DedupTest(SandboxTest):
+    rules = {"game": ["saves $home/saves", "copy $home/copy"]}
+
+    def setUp(self):
+        super().setUp()
+        self.home = self.sandbox.home("a")
+
+    def run_machine(self, *args):
+        self.sandbox.forget_fingerprints()
+        return self.sandbox.run("a", *args, config="[output]\ndedup=1")
+
+    def blobs(self):
+        return sorted(path.name for path in (self.sandbox.output / ".blobs").rglob("*") if path.is_file() and path.name != ".gitignore")
+
+    def test_same_content_is_one_blob(self):
+        for rule in ["saves", "copy"]:
+            self.sandbox.write(self.home / rule / "slot1", "same")
+        self.run_machine()
+        saves, copy = [self.sandbox.output / "game" / rule / "slot1" for rule in ["saves", "copy"]]
+        self.assertEqual(saves.stat().st_ino, copy.stat().st_ino)
+        self.assertEqual(len(self.blobs()), 1)
+
+    def test_blobs_no_file_has_are_removed(self):
+        for rule in ["saves", "copy"]:
+            self.sandbox.write(self.home / rule / "slot1", "v1")
+        self.run_machine()
+        old_blobs = self.blobs()
+        for rule in ["saves", "copy"]:
+            self.sandbox.write(self.home / rule / "slot1", "v2")
+        self.run_machine()
+        self.assertEqual(len(self.blobs()), 1)
+        self.assertNotEqual(self.blobs(), old_blobs)
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1").read_text(), "v2")
+
+    def test_restore_of_a_deduplicated_file(self):
+        self.sandbox.write(self.home / "saves" / "slot1", "v1")
+        self.run_machine()
+        (self.home / "saves" / "slot1").unlink()
+        self.run_machine("restore", "game")
+        self.assertEqual((self.home / "saves" / "slot1").read_text(), "v1")
+
+
+class RestoreTest(SandboxTest):
+    rules = {"game": ["saves $home/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        self.slot = self.sandbox.home("a") / "saves" / "slot1"
+        self.sandbox.write(self.slot, "v1")
+        self.sandbox.run("a")
+        # changed after the backup, so newer than it
+        self.sandbox.write(self.slot, "local")
+
+    def kept(self):
+        return [path.read_text() for path in (self.sandbox.output / "__backup__").rglob("slot1")]
+
+    def test_newer_file_is_not_overwritten_without_asking(self):
+        result = self.sandbox.run("a", "restore", "game")
+        self.assertIn("it's newer than the backup", result.stdout)
+        self.assertEqual(self.slot.read_text(), "local")
+
+    def test_overwritten_file_is_kept_in_backup(self):
+        self.sandbox.run("a", "restore", "game", "-y")
+        self.assertEqual(self.slot.read_text(), "v1")
+        self.assertEqual(self.kept(), ["local"])
+
+
+class RemapTest(SandboxTest):
+    rules = {"game": ["saves $installdir/saves", "settings $installdir/settings"]}
+
+    def setUp(self):
+        super().setUp()
+        self.old = self.sandbox.dir / "games" / "old"
+        self.new = self.sandbox.dir / "games" / "new"
+        self.sandbox.write(self.old / "saves" / "slot1", "v1")
+        self.sandbox.write(self.old / "settings" / "recent.txt", f"{self.old}/saves/slot1\n{self.old}2/saves/slot1\n")
+        self.sandbox.run("a", config=f"[game]\ninstalldir={self.old}\ntransform_settings=remap_paths")
+        (self.new / "saves").mkdir(parents=True)
+        (self.new / "settings").mkdir()
+
+    def restore(self):
+        self.sandbox.run("a", "restore", "game", config=f"[game]\ninstalldir={self.old}\ntransform_settings=remap_paths\n[remap]\npaths={self.old}={self.new}")
+
+    def test_restore_goes_to_the_new_folder(self):
+        self.restore()
+        self.assertEqual((self.new / "saves" / "slot1").read_text(), "v1")
+
+    def test_only_whole_folders_are_remapped_in_files(self):
+        self.restore()
+        self.assertEqual((self.new / "settings" / "recent.txt").read_text(), f"{self.new}/saves/slot1\n{self.old}2/saves/slot1\n")
+
+
+class SecurityTest(SandboxTest):
+    rules = {"game": ["saves $home/saves", "settings $home/settings"], "escape": ["saves $home/../disk/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        # the save folder was moved to another disk and linked back to where the game looks for it
+        self.disk = self.sandbox.dir / "homes" / "disk" / "saves"
+        self.sandbox.write(self.disk / "slot1", "v1")
+        (self.sandbox.home("a") / "saves").symlink_to(self.disk)
+        self.sandbox.write(self.sandbox.home("a") / "settings" / "game.ini", "volume=1")
+
+    def copied(self, app: str, *path):
+        return (self.sandbox.output / app).joinpath(*path).exists()
+
+    def security_log(self):
+        log = self.sandbox.output / "__meta__" / "security.jsonl"
+        return [json.loads(line) for line in log.read_text().splitlines()] if log.exists() else []
+
+    def test_symlink_out_is_blocked(self):
+        result = self.sandbox.run("a")
+        self.assertIn("through a symlink", result.stdout)
+        self.assertFalse(self.copied("game", "saves", "slot1"))
+        # strict leaves out the rest of the app too
+        self.assertFalse(self.copied("game", "settings", "game.ini"))
+        self.assertIn(dict(app="game", reason="symlink", allowed=False), [dict(app=event["app"], reason=event["reason"], allowed=event["allowed"]) for event in self.security_log()])
+
+    def test_follow_symlinks_out_of_the_app(self):
+        result = self.sandbox.run("a", config="[game]\nfollow_symlinks_out=1")
+        self.assertNotIn("through a symlink", result.stdout)
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1").read_text(), "v1")
+        self.assertTrue(self.copied("game", "settings", "game.ini"))
+
+    def test_follow_symlinks_out_of_all_apps(self):
+        self.sandbox.run("a", config="[security]\nfollow_symlinks_out=1")
+        self.assertTrue(self.copied("game", "saves", "slot1"))
+
+    def test_traversal_is_blocked_even_when_following_symlinks_out(self):
+        result = self.sandbox.run("a", config="[security]\nfollow_symlinks_out=1")
+        self.assertIn("through ..", result.stdout)
+        self.assertFalse(self.copied("escape", "saves", "slot1"))
+
+    def test_warn_mode_copies_with_a_warning(self):
+        result = self.sandbox.run("a", config="[security]\nmode=warn")
+        self.assertIn("security mode is warn", result.stdout)
+        self.assertTrue(self.copied("game", "saves", "slot1"))
+        self.assertTrue(self.copied("escape", "saves", "slot1"))
+
+    def test_off_mode_copies_silently(self):
+        result = self.sandbox.run("a", config="[security]\nmode=off")
+        self.assertNotIn("Warning", result.stdout)
+        self.assertTrue(self.copied("game", "saves", "slot1"))
+        self.assertTrue(self.copied("escape", "saves", "slot1"))
+
+    def test_restore_follows_symlinks_out_only_when_allowed(self):
+        self.sandbox.run("a", config="[game]\nfollow_symlinks_out=1")
+        (self.disk / "slot1").unlink()
+        self.sandbox.run("a", "restore", "game")
+        self.assertFalse((self.disk / "slot1").exists())
+        self.sandbox.run("a", "restore", "game", config="[game]\nfollow_symlinks_out=1")
+        self.assertEqual((self.disk / "slot1").read_text(), "v1")
+
+
+class CliTest(SandboxTest):
+    rules = {"game": ["saves $home/saves", "settings $home/settings"]}
+
+    def setUp(self):
+        super().setUp()
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v1")
+
+    def test_flag_set_to_0_is_off(self):
+        self.sandbox.run("a", config="[cli]\ngit=0")
+        self.assertFalse((self.sandbox.output / ".git").exists())
+
+    def test_flag_set_to_1_is_on(self):
+        self.sandbox.run("a", config="[cli]\ngit=1")
+        self.assertTrue((self.sandbox.output / ".git").exists())
+
+    def test_no_flag_turns_off_the_config(self):
+        self.sandbox.run("a", "--no-git", config="[cli]\ngit=1")
+        self.assertFalse((self.sandbox.output / ".git").exists())
+
+    def test_invalid_value_fails(self):
+        result = self.sandbox.run("a", config="[cli]\ngit=maybe", check=False)
+        self.assertNotEqual(result.returncode, 0)
+        self.assertIn("'maybe' is not a valid value for git in [cli]", result.stdout + result.stderr)
+
+    def test_ignore_rule_set_to_anything(self):
+        self.sandbox.write(self.sandbox.home("a") / "settings" / "game.ini", "settings")
+        for value in ["", "0", "1"]:
+            with self.subTest(value=value):
+                shutil.rmtree(self.sandbox.output, ignore_errors=True)
+                self.sandbox.run("a", config=f"[game]\nignore_saves={value}")
+                self.assertFalse((self.sandbox.output / "game" / "saves").exists())
+                self.assertTrue((self.sandbox.output / "game" / "settings" / "game.ini").exists())
+
+
+class GogTest(SandboxTest):
+    def setUp(self):
+        super().setUp()
+        self.applications = self.sandbox.home("a") / "AppData" / "Local" / "GOG.com" / "Galaxy" / "Applications"
+        for client_id in ["111", "222"]:
+            self.sandbox.write(self.applications / client_id / "Storage" / "save.dat", client_id)
+
+    def run_machine(self, *args):
+        self.sandbox.forget_fingerprints()
+        return self.sandbox.run("a", *args, config="[game]\ngog_client_id=111,222")
+
+    def test_each_client_id_has_its_own_folder(self):
+        self.run_machine()
+        for client_id in ["111", "222"]:
+            self.assertEqual((self.sandbox.output / "game" / "gog_cloud" / client_id / "save.dat").read_text(), client_id)
+
+    def test_restore_puts_each_client_id_back(self):
+        self.run_machine()
+        for client_id in ["111", "222"]:
+            (self.applications / client_id / "Storage" / "save.dat").unlink()
+        self.run_machine("restore", "game")
+        for client_id in ["111", "222"]:
+            self.assertEqual((self.applications / client_id / "Storage" / "save.dat").read_text(), client_id)
+
+
+class SteamTest(SandboxTest):
+    rules = {"game": ["config $steam/config/game", "saves $steamapps/common/Game/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        self.steam = self.sandbox.home("a") / ".local" / "share" / "Steam"
+        self.sandbox.write(self.steam / "config" / "game" / "settings.cfg", "config")
+        self.sandbox.write(self.steam / "steamapps" / "common" / "Game" / "saves" / "slot1", "v1")
+
+    def test_steam_and_steamapps_resolve_to_their_folders(self):
+        self.sandbox.run("a")
+        self.assertEqual((self.sandbox.output / "game" / "config" / "settings.cfg").read_text(), "config")
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1").read_text(), "v1")
+
+    def test_restore_puts_them_back(self):
+        self.sandbox.run("a")
+        (self.steam / "config" / "game" / "settings.cfg").unlink()
+        (self.steam / "steamapps" / "common" / "Game" / "saves" / "slot1").unlink()
+        self.sandbox.run("a", "restore", "game")
+        self.assertEqual((self.steam / "config" / "game" / "settings.cfg").read_text(), "config")
+        self.assertEqual((self.steam / "steamapps" / "common" / "Game" / "saves" / "slot1").read_text(), "v1")
+
+
+class WineTest(SandboxTest):
+    rules = {"game": ["saves $winedrive_c/Game/saves", "settings $home/AppData/Roaming/Game"]}
+
+    def setUp(self):
+        super().setUp()
+        self.drive_c = self.sandbox.home("a") / ".wine" / "drive_c"
+        self.sandbox.write(self.drive_c / "Game" / "saves" / "slot1", "v1")
+        self.sandbox.write(self.drive_c / "users" / "player" / "AppData" / "Roaming" / "Game" / "settings.ini", "settings")
+
+    def test_prefix_is_found(self):
+        self.sandbox.run("a")
+        self.assertEqual((self.sandbox.output / "game" / "saves" / "slot1").read_text(), "v1")
+        self.assertEqual((self.sandbox.output / "game" / "settings" / "settings.ini").read_text(), "settings")
+
+    def test_restore_puts_them_back_in_the_prefix(self):
+        self.sandbox.run("a")
+        (self.drive_c / "Game" / "saves" / "slot1").unlink()
+        self.sandbox.run("a", "restore", "game")
+        self.assertEqual((self.drive_c / "Game" / "saves" / "slot1").read_text(), "v1")
+
+
+class TransformTest(SandboxTest):
+    rules = {"game": ["settings $home/settings", "saves $home/saves"]}
+
+    def setUp(self):
+        super().setUp()
+        self.settings = self.sandbox.home("a") / "settings"
+
+    def run_machine(self, *args, **kwargs):
+        self.sandbox.forget_fingerprints()
+        return self.sandbox.run("a", *args, config="[game]\ntransform_settings=canonicalize", **kwargs)
+
+    def test_canonicalize_keeps_the_file_as_written(self):
+        written = '<?xml version="1.0"?>\n<!DOCTYPE config>\n<config b="2" a="1"/>\n'
+        self.sandbox.write(self.settings / "config.xml", written)
+        self.run_machine()
+        self.assertEqual((self.sandbox.output / "game" / "settings" / "config.xml").read_text(), written)
+        (self.settings / "config.xml").unlink()
+        self.run_machine("restore", "game")
+        self.assertEqual((self.settings / "config.xml").read_text(), written)
+
+    def test_canonicalize_ignores_reordering(self):
+        self.sandbox.write(self.settings / "config.json", '{"a": 1, "b": 2}')
+        self.run_machine()
+        self.sandbox.write(self.settings / "config.json", '{\n  "b": 2,\n  "a": 1\n}')
+        self.run_machine()
+        self.assertEqual((self.sandbox.output / "game" / "settings" / "config.json").read_text(), '{"a": 1, "b": 2}')
+        self.sandbox.write(self.settings / "config.json", '{"a": 1, "b": 3}')
+        self.run_machine()
+        self.assertEqual((self.sandbox.output / "game" / "settings" / "config.json").read_text(), '{"a": 1, "b": 3}')
+
+    def test_manifest_has_the_hash_of_the_output(self):
+        self.sandbox.write(self.settings / "config.ini", "[a]\r\nb=1\r\n")
+        self.sandbox.write(self.sandbox.home("a") / "saves" / "slot1", "v1")
+        self.sandbox.forget_fingerprints()
+        self.sandbox.run("a", config="[game]\ntransform_settings=normalize_eol")
+        for key in ["game/settings/config.ini", "game/saves/slot1"]:
+            with self.subTest(key=key):
+                output = (self.sandbox.output / key).read_bytes()
+                self.assertEqual(self.sandbox.manifest()[key]["hash"], f"sha256:{hashlib.sha256(output).hexdigest()}")
+
+    def test_canonicalize_keeps_the_order_of_repeated_keys(self):
+        self.sandbox.write(self.settings / "mods.ini", "[mods]\nmod=b\nmod=a\n")
+        self.run_machine()
+        self.sandbox.write(self.settings / "mods.ini", "[mods]\nmod=a\nmod=b\n")
+        self.run_machine()
+        self.assertEqual((self.sandbox.output / "game" / "settings" / "mods.ini").read_text(), "[mods]\nmod=a\nmod=b\n")
+
+
+if __name__ == "__main__":
+    unittest.main()